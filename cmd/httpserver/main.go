@@ -1,50 +1,142 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/lucoand/httpfromtcp/internal/router"
 	"github.com/lucoand/httpfromtcp/internal/server"
 )
 
 const port = 42069
 
-func handler(w io.Writer, req *request.Request) *server.HandlerError {
-	fmt.Println("Handler entered")
-	target := req.RequestLine.RequestTarget
-	if target == "/yourproblem" {
+// shutdownTimeout is how long in-flight requests get to finish on SIGINT or
+// SIGTERM before their connections are cut.
+const shutdownTimeout = 10 * time.Second
+
+func yourProblem(w *response.Writer, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{
+		StatusCode: response.StatusBadRequest,
+		Message:    "Your problem is not my problem\n",
+	}
+}
+
+func myProblem(w *response.Writer, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{
+		StatusCode: response.StatusInternalServerError,
+		Message:    "Woopsie, my bad\n",
+	}
+}
+
+func allGood(w *response.Writer, req *request.Request) *server.HandlerError {
+	bodyString := "All good, frfr\n"
+	bodyBytes := []byte(bodyString)
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(bodyBytes)))
+	w.WriteBody(bodyBytes)
+	return nil
+}
+
+func newRouter() *router.Router {
+	rt := router.New()
+	rt.Handle("/yourproblem", yourProblem)
+	rt.Handle("/myproblem", myProblem)
+	rt.Handle("GET /httpbin/{path...}", proxyHTTPBin)
+	rt.Handle("/{path...}", allGood)
+	return rt
+}
+
+// proxyHTTPBin streams the matching httpbin.org response back to the
+// client as a chunked body, with its hash and length as trailers.
+func proxyHTTPBin(w *response.Writer, req *request.Request) *server.HandlerError {
+	url := "https://httpbin.org/" + req.Param("path")
+	if req.Target.RawQuery != "" {
+		url += "?" + req.Target.RawQuery
+	}
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, url, nil)
+	if err != nil {
 		return &server.HandlerError{
-			StatusCode: "400",
-			Message:    "Your problem is not my problem\n",
+			StatusCode: response.StatusInternalServerError,
+			Message:    "Could not build upstream request\n",
 		}
 	}
-	if target == "/myproblem" {
+	upstream, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
 		return &server.HandlerError{
-			StatusCode: "500",
-			Message:    "Woopsie, my bad\n",
+			StatusCode: response.StatusBadGateway,
+			Message:    "Upstream request failed\n",
 		}
 	}
-	bodyString := "All good, frfr\n"
-	bodyBytes := []byte(bodyString)
-	w.Write(bodyBytes)
+	defer upstream.Body.Close()
+
+	w.WriteStatusLine(response.StatusCode(upstream.StatusCode))
+	h := response.GetChunkedHeaders(response.TrailerContentSHA256, response.TrailerContentLength)
+	if contentType := upstream.Header.Get("Content-Type"); contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	w.WriteHeaders(h)
+	// The response has started, so a failure can only be signalled by
+	// returning an error, which makes the server abort the connection
+	// instead of ending the body with trailers for truncated data.
+	interrupted := &server.HandlerError{
+		StatusCode: response.StatusBadGateway,
+		Message:    "Upstream response interrupted\n",
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := upstream.Body.Read(buf)
+		if n > 0 {
+			_, writeErr := w.WriteChunkedBody(buf[:n])
+			if writeErr != nil {
+				return interrupted
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return interrupted
+		}
+	}
+	w.WriteChunkedBodyDone()
 	return nil
 }
 
 func main() {
-	server, err := server.Serve(port, handler)
+	server := &server.Server{
+		Addr:              fmt.Sprintf("127.0.0.1:%d", port),
+		Handler:           newRouter().Serve,
+		ReadHeaderTimeout: server.DefaultReadHeaderTimeout,
+		IdleTimeout:       server.DefaultIdleTimeout,
+		Limits:            server.DefaultLimits,
+		AccessLog:         os.Stdout,
+		AccessLogFormat:   server.AccessLogCombined,
+	}
+	err := server.Start()
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error during shutdown: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -1,44 +1,263 @@
 package headers
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"slices"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers is an ordered list of header fields. Each field keeps the casing
+// of its name as first seen and all of its values, so fields which may not
+// be combined, like Set-Cookie, survive intact. Names are matched
+// case-insensitively. The zero value is an empty Headers ready to use.
+type Headers struct {
+	fields []field
+	// index maps each lowercase name to its position in fields
+	index map[string]int
+	// lastName is the name of the field Parse added a value to last, which
+	// an obs-fold line continues
+	lastName string
+}
+
+// Policy selects how Parse treats the obsolete field value syntax of RFC
+// 9112, and which values Validate lets through when writing. The zero value
+// accepts obs-text and rejects obs-fold.
+type Policy struct {
+	// RejectObsText rejects values containing bytes 0x80-0xFF.
+	RejectObsText bool
+	// UnfoldObsFold accepts values continued on a line starting with a
+	// space or tab, replacing the line break with a space, instead of
+	// rejecting them.
+	UnfoldObsFold bool
+}
+
+type field struct {
+	name   string
+	values []string
+}
 
 const CRLF = "\r\n"
 
+// ErrWhitespaceBeforeColon is returned by Parse for a field line with
+// whitespace between the name and the colon, which RFC 9112 requires a
+// server to reject.
+var ErrWhitespaceBeforeColon = errors.New("whitespace between field name and colon")
+
 const allowedNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#$%&'*+-.^_`|~"
 
-func NewHeaders() Headers {
-	return make(map[string]string)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Print() {
+func (h *Headers) Print() {
 	fmt.Println("Headers:")
-	for k, v := range h {
-		fmt.Printf("- %s: %s\n", k, v)
+	for name, value := range h.All() {
+		fmt.Printf("- %s: %s\n", name, value)
 	}
 }
 
-func (h Headers) Get(key string) string {
-	key = strings.ToLower(key)
-	value, exists := h[key]
+func (h *Headers) lookup(key string) (int, bool) {
+	if h == nil || h.index == nil {
+		return 0, false
+	}
+	i, exists := h.index[strings.ToLower(key)]
+	return i, exists
+}
+
+// Get returns the values of the named field joined with ", ", or "" if
+// there is no such field.
+func (h *Headers) Get(key string) string {
+	i, exists := h.lookup(key)
 	if !exists {
 		return ""
 	}
-	return value
+	return strings.Join(h.fields[i].values, ", ")
+}
+
+// Values returns a copy of the values of the named field, in the order
+// they were added.
+func (h *Headers) Values(key string) []string {
+	i, exists := h.lookup(key)
+	if !exists {
+		return nil
+	}
+	return slices.Clone(h.fields[i].values)
+}
+
+// Has reports whether the named field is present.
+func (h *Headers) Has(key string) bool {
+	_, exists := h.lookup(key)
+	return exists
 }
 
-func (h Headers) put(key string, value string) {
-	key = strings.ToLower(key)
-	oldValue, exists := h[key]
+// Add appends value to the named field, adding the field after the
+// existing ones if it is new.
+func (h *Headers) Add(key string, value string) {
+	i, exists := h.lookup(key)
 	if exists {
-		h[key] = oldValue + ", " + value
+		h.fields[i].values = append(h.fields[i].values, value)
 		return
 	}
-	h[key] = value
+	if h.index == nil {
+		h.index = make(map[string]int)
+	}
+	h.index[strings.ToLower(key)] = len(h.fields)
+	h.fields = append(h.fields, field{name: key, values: []string{value}})
+}
+
+// Set replaces the values of the named field with value. An existing field
+// keeps its position and the casing of its name.
+func (h *Headers) Set(key string, value string) {
+	i, exists := h.lookup(key)
+	if exists {
+		h.fields[i].values = []string{value}
+		return
+	}
+	h.Add(key, value)
+}
+
+// Del removes the named field.
+func (h *Headers) Del(key string) {
+	i, exists := h.lookup(key)
+	if !exists {
+		return
+	}
+	h.fields = slices.Delete(h.fields, i, i+1)
+	delete(h.index, strings.ToLower(key))
+	for j := i; j < len(h.fields); j++ {
+		h.index[strings.ToLower(h.fields[j].name)] = j
+	}
+}
+
+// Len returns the number of distinct fields.
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// Clone returns a deep copy of h.
+func (h *Headers) Clone() *Headers {
+	clone := NewHeaders()
+	for name, value := range h.All() {
+		clone.Add(name, value)
+	}
+	return clone
+}
+
+// All yields every name and value pair in order, a field with several
+// values yielding once per value.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+		for _, f := range h.fields {
+			for _, v := range f.values {
+				if !yield(f.name, v) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Validate checks with the default Policy that every field would be parsed
+// back as written: names must be tokens, and values must not contain CR,
+// LF, NUL or other control characters, which could otherwise split a
+// message in two.
+func (h *Headers) Validate() error {
+	return h.ValidateWithPolicy(Policy{})
+}
+
+// ValidateWithPolicy is Validate also rejecting obs-text if p does.
+func (h *Headers) ValidateWithPolicy(p Policy) error {
+	for name, value := range h.All() {
+		err := validName(name)
+		if err != nil {
+			return err
+		}
+		err = validValue(value, p)
+		if err != nil {
+			return fmt.Errorf("%w in field %q", err, name)
+		}
+	}
+	return nil
+}
+
+// Write writes each field value as a "Name: value" line, in order. It
+// does not write the empty line that ends a header section. A field whose
+// name or value could not be parsed back, such as a value containing CR or
+// LF, is an error and nothing is written.
+func (h *Headers) Write(w io.Writer) error {
+	return h.WriteWithPolicy(w, Policy{})
+}
+
+// WriteWithPolicy is Write validating the fields according to p.
+func (h *Headers) WriteWithPolicy(w io.Writer, p Policy) error {
+	// Check every field first, so an invalid one leaves nothing
+	// half-written.
+	err := h.ValidateWithPolicy(p)
+	if err != nil {
+		return err
+	}
+	for name, value := range h.All() {
+		line := []byte(name + ": " + value + CRLF)
+		n, err := w.Write(line)
+		if err != nil {
+			return err
+		}
+		if n != len(line) {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// HasToken reports whether the comma-separated list in the named field
+// contains token, compared case-insensitively (e.g. "Connection: close").
+func (h *Headers) HasToken(key string, token string) bool {
+	for _, v := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func validName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Missing field name")
+	}
+	for _, r := range name {
+		if !strings.ContainsRune(allowedNameChars, r) {
+			return fmt.Errorf("Invalid character in field name %q", name)
+		}
+	}
+	return nil
+}
+
+// validValue checks value against the field-value grammar of RFC 9110:
+// visible characters, spaces and tabs, and obs-text unless p rejects it.
+// CR, LF, NUL and the other control characters are never allowed.
+func validValue(value string, p Policy) error {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\t' || (c >= ' ' && c != 0x7f && c < 0x80):
+		case c >= 0x80:
+			if p.RejectObsText {
+				return fmt.Errorf("Invalid obs-text byte 0x%02x in field value", c)
+			}
+		default:
+			return fmt.Errorf("Invalid control character 0x%02x in field value", c)
+		}
+	}
+	return nil
 }
 
 // func printDataStringWithControlChars(dataString string) {
@@ -54,7 +273,15 @@ func (h Headers) put(key string, value string) {
 // 	fmt.Println()
 // }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// Parse parses one field line from data with the default Policy. It returns
+// the number of bytes consumed, and done once it reaches the empty line
+// ending the section.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.ParseWithPolicy(data, Policy{})
+}
+
+// ParseWithPolicy is Parse treating obsolete value syntax according to p.
+func (h *Headers) ParseWithPolicy(data []byte, p Policy) (n int, done bool, err error) {
 	done = false
 	n = 0
 	err = nil
@@ -69,9 +296,17 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		done = true
 		return
 	}
+	if data[0] == ' ' || data[0] == '\t' {
+		return h.parseObsFold(dataString, p)
+	}
 	splitIndex := 0
 	for i, r := range dataString {
-		if r == ' ' {
+		if r == ' ' || r == '\t' {
+			rest, _, found := strings.Cut(dataString[i:], ":")
+			if found && i > 0 && strings.Trim(rest, " \t") == "" {
+				err = ErrWhitespaceBeforeColon
+				return
+			}
 			err = fmt.Errorf("Unexpeted whitespace in field name")
 			return
 		}
@@ -99,17 +334,41 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		err = fmt.Errorf("Missing field value in header")
 		return
 	}
-	fieldName := strings.ToLower(dataString[:splitIndex])
+	fieldName := dataString[:splitIndex]
 	fieldValue := dataString[splitIndex+1:]
 	valueParts := strings.Split(fieldValue, CRLF)
 	fieldValue = valueParts[0]
 	n = 3 + len(fieldValue) + len(fieldName)
-	fieldValue = strings.TrimSpace(fieldValue)
-	h.put(fieldName, fieldValue)
+	err = validValue(fieldValue, p)
+	if err != nil {
+		n = 0
+		return
+	}
+	fieldValue = strings.Trim(fieldValue, " \t")
+	h.Add(fieldName, fieldValue)
+	h.lastName = fieldName
 	// fmt.Print("BEGIN Parsed data: ")
 	// printDataStringWithControlChars(dataString)
 	// fmt.Println("END")
 	// fmt.Printf("n = %d\n", n)
-	// fmt.Printf("%s: %s\n", fieldName, h[fieldName])
 	return
 }
+
+// parseObsFold handles a line continuing the previous field's value.
+func (h *Headers) parseObsFold(dataString string, p Policy) (int, bool, error) {
+	if !p.UnfoldObsFold || h.lastName == "" {
+		return 0, false, fmt.Errorf("Obsolete line folding is not allowed")
+	}
+	line, _, _ := strings.Cut(dataString, CRLF)
+	err := validValue(line, p)
+	if err != nil {
+		return 0, false, err
+	}
+	i, exists := h.lookup(h.lastName)
+	if !exists {
+		return 0, false, fmt.Errorf("Obsolete line folding is not allowed")
+	}
+	values := h.fields[i].values
+	values[len(values)-1] += " " + strings.Trim(line, " \t")
+	return len(line) + len(CRLF), false, nil
+}
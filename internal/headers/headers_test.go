@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -131,3 +132,131 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeadersHasToken(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Connection: keep-alive, Close\r\n\r\n")
+	_, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, headers.HasToken("connection", "close"))
+	assert.True(t, headers.HasToken("Connection", "Keep-Alive"))
+	assert.False(t, headers.HasToken("connection", "upgrade"))
+	assert.False(t, headers.HasToken("transfer-encoding", "chunked"))
+}
+
+func TestHeadersMultiValue(t *testing.T) {
+	// Test: Repeated fields keep every value, and Get still joins them
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("set-cookie"))
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT, b=2", headers.Get("Set-Cookie"))
+	assert.Equal(t, 1, headers.Len())
+
+	// Test: Add, Set and Del keep the order fields were first added in
+	headers = NewHeaders()
+	headers.Add("Content-Type", "text/plain")
+	headers.Add("X-Tag", "one")
+	headers.Add("Vary", "Accept")
+	headers.Add("x-tag", "two")
+	headers.Set("content-type", "text/html")
+	headers.Del("VARY")
+	headers.Add("Date", "today")
+	var buf bytes.Buffer
+	require.NoError(t, headers.Write(&buf))
+	assert.Equal(t, "Content-Type: text/html\r\nX-Tag: one\r\nX-Tag: two\r\nDate: today\r\n", buf.String())
+	assert.False(t, headers.Has("vary"))
+	assert.Nil(t, headers.Values("vary"))
+
+	// Test: A clone is independent of the original
+	clone := headers.Clone()
+	clone.Add("X-Tag", "three")
+	clone.Del("Date")
+	assert.Equal(t, []string{"one", "two"}, headers.Values("x-tag"))
+	assert.Equal(t, "today", headers.Get("date"))
+	assert.Equal(t, []string{"one", "two", "three"}, clone.Values("x-tag"))
+
+	// Test: The zero value is usable
+	var zero Headers
+	assert.Equal(t, "", zero.Get("host"))
+	zero.Set("Host", "localhost")
+	assert.Equal(t, "localhost", zero.Get("HOST"))
+}
+
+func TestHeadersValueValidation(t *testing.T) {
+	// Test: NUL, bare CR and bare LF in values are rejected
+	for _, line := range []string{
+		"X-Bad: a\x00b\r\n\r\n",
+		"X-Bad: a\rb\r\n\r\n",
+		"X-Bad: a\nInjected: yes\r\n\r\n",
+		"X-Bad: a\x7fb\r\n\r\n",
+	} {
+		headers := NewHeaders()
+		n, done, err := headers.Parse([]byte(line))
+		require.Error(t, err, "%q", line)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+		assert.Equal(t, 0, headers.Len())
+	}
+
+	// Test: Tabs inside values are kept, surrounding ones trimmed
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X-Tab:\ta\tb\t\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\tb", headers.Get("x-tab"))
+
+	// Test: obs-text is accepted unless the policy rejects it
+	data := []byte("X-Name: caf\xe9\r\n\r\n")
+	headers = NewHeaders()
+	_, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, "caf\xe9", headers.Get("x-name"))
+	headers = NewHeaders()
+	_, _, err = headers.ParseWithPolicy(data, Policy{RejectObsText: true})
+	require.Error(t, err)
+
+	// Test: The same policy applies when writing
+	headers = NewHeaders()
+	headers.Set("X-Name", "caf\xe9")
+	require.NoError(t, headers.Validate())
+	require.Error(t, headers.ValidateWithPolicy(Policy{RejectObsText: true}))
+	out := &bytes.Buffer{}
+	require.Error(t, headers.WriteWithPolicy(out, Policy{RejectObsText: true}))
+	assert.Empty(t, out.String())
+
+	// Test: obs-fold is rejected unless the policy unfolds it
+	data = []byte("X-Long: first\r\n  second\r\n\r\n")
+	headers = NewHeaders()
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.Error(t, err)
+	headers = NewHeaders()
+	policy := Policy{UnfoldObsFold: true}
+	n, _, err = headers.ParseWithPolicy(data, policy)
+	require.NoError(t, err)
+	m, done, err := headers.ParseWithPolicy(data[n:], policy)
+	require.NoError(t, err)
+	assert.Equal(t, len("  second\r\n"), m)
+	assert.False(t, done)
+	assert.Equal(t, "first second", headers.Get("x-long"))
+
+	// Test: A fold with no field to continue is rejected
+	headers = NewHeaders()
+	_, _, err = headers.ParseWithPolicy([]byte(" orphan\r\n\r\n"), policy)
+	require.Error(t, err)
+
+	// Test: Write refuses values that would split the message
+	headers = NewHeaders()
+	headers.Set("Content-Type", "text/plain")
+	headers.Set("Location", "/next\r\nSet-Cookie: evil=1")
+	var buf bytes.Buffer
+	require.Error(t, headers.Write(&buf))
+	assert.Empty(t, buf.String())
+	headers = NewHeaders()
+	headers.Set("Bad Name", "value")
+	require.Error(t, headers.Write(&buf))
+}
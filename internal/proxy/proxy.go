@@ -0,0 +1,266 @@
+// Package proxy provides a reverse-proxy handler that forwards requests to
+// an upstream server over a raw TCP connection.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/lucoand/httpfromtcp/internal/server"
+)
+
+// DefaultDialTimeout bounds connecting to the upstream when a ReverseProxy
+// has no DialTimeout.
+const DefaultDialTimeout = 10 * time.Second
+
+// hopByHopHeaders apply to a single connection and are never forwarded, in
+// either direction. Fields named in a Connection header are dropped too.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// ReverseProxy forwards each request to Upstream and streams the response
+// back. Every request uses a fresh upstream connection.
+type ReverseProxy struct {
+	// Upstream is the "host:port" requests are sent to.
+	Upstream string
+	// DialTimeout bounds connecting to Upstream. Zero means
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+}
+
+func New(upstream string) *ReverseProxy {
+	return &ReverseProxy{Upstream: upstream}
+}
+
+// Handle is a server.Handler forwarding req to the upstream.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) *server.HandlerError {
+	dialTimeout := p.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(req.Context(), "tcp", p.Upstream)
+	if err != nil {
+		return badGateway("Could not reach upstream")
+	}
+	defer conn.Close()
+	// Unblock reads and writes on the upstream if the client goes away.
+	stop := context.AfterFunc(req.Context(), func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	bw := bufio.NewWriter(conn)
+	err = writeUpstreamRequest(bw, req, p.Upstream)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return badGateway("Could not send request upstream")
+	}
+	resp, err := readResponse(bufio.NewReader(conn), req.RequestLine.Method)
+	if err != nil {
+		return badGateway("Invalid response from upstream")
+	}
+	err = copyResponse(w, resp)
+	if err != nil {
+		// Part of the response may already be out; returning an error
+		// makes the server abort the connection rather than finish a
+		// truncated body as if it were complete.
+		return badGateway("Upstream response interrupted")
+	}
+	return nil
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func badGateway(message string) *server.HandlerError {
+	return &server.HandlerError{
+		StatusCode: response.StatusBadGateway,
+		Message:    message + "\n",
+	}
+}
+
+// forwardHeaders copies h without its hop-by-hop fields.
+func forwardHeaders(h *headers.Headers) *headers.Headers {
+	out := h.Clone()
+	for _, name := range strings.Split(h.Get("connection"), ",") {
+		out.Del(strings.TrimSpace(name))
+	}
+	for _, name := range hopByHopHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// clientIP returns the host part of a "host:port" remote address.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// appendField adds value to a comma-separated list field.
+func appendField(h *headers.Headers, key string, value string) {
+	if prior := h.Get(key); prior != "" {
+		value = prior + ", " + value
+	}
+	h.Set(key, value)
+}
+
+// writeUpstreamRequest writes req as an HTTP/1.1 request with the
+// X-Forwarded-For and Forwarded fields added, streaming its body: a body of
+// known length keeps its Content-Length and any other is re-chunked along
+// with its trailers.
+func writeUpstreamRequest(w io.Writer, req *request.Request, upstream string) error {
+	h := forwardHeaders(req.Headers)
+	h.Set("Connection", "close")
+	if !h.Has("host") {
+		// HTTP/1.0 clients may leave Host out, but HTTP/1.1 requires it.
+		h.Set("Host", upstream)
+	}
+	chunked := req.Headers.Has("transfer-encoding")
+	if chunked {
+		h.Set("Transfer-Encoding", "chunked")
+	} else if !h.Has("content-length") && len(req.Body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	if req.RemoteAddr != "" {
+		ip := clientIP(req.RemoteAddr)
+		appendField(h, "X-Forwarded-For", ip)
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = `"[` + ip + `]"`
+		}
+		forwarded := "for=" + node
+		if host := req.Headers.Get("host"); host != "" {
+			forwarded += ";host=" + strconv.Quote(host)
+		}
+		appendField(h, "Forwarded", forwarded+";proto=http")
+	}
+	line := fmt.Appendf(nil, "%s %s HTTP/1.1\r\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	n, err := w.Write(line)
+	err = response.WriteErrorHelper(err, n, line)
+	if err != nil {
+		return err
+	}
+	err = response.WriteHeaders(w, h)
+	if err != nil {
+		return err
+	}
+	if !chunked {
+		_, err = io.Copy(w, requestBody(req))
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	body := requestBody(req)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			chunk := fmt.Appendf(nil, "%x\r\n", n)
+			chunk = append(chunk, buf[:n]...)
+			chunk = append(chunk, headers.CRLF...)
+			written, err := w.Write(chunk)
+			err = response.WriteErrorHelper(err, written, chunk)
+			if err != nil {
+				return err
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	lastChunk := []byte("0\r\n")
+	n, err = w.Write(lastChunk)
+	err = response.WriteErrorHelper(err, n, lastChunk)
+	if err != nil {
+		return err
+	}
+	// Trailers are only known once the body has been read to the end.
+	return response.WriteHeaders(w, forwardHeaders(req.Trailers))
+}
+
+// requestBody returns what is left of req's body: whatever was already
+// read into Body, followed by the rest of BodyReader.
+func requestBody(req *request.Request) io.Reader {
+	if req.BodyReader == nil {
+		return bytes.NewReader(req.Body)
+	}
+	return io.MultiReader(bytes.NewReader(req.Body), req.BodyReader)
+}
+
+// copyResponse streams resp to w. A body of known length keeps its
+// Content-Length; any other body is re-chunked, carrying the upstream
+// trailers along.
+func copyResponse(w *response.Writer, resp *upstreamResponse) error {
+	h := forwardHeaders(resp.Headers)
+	chunked := resp.ContentLength < 0
+	if chunked {
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		if trailer := resp.Headers.Get("trailer"); trailer != "" {
+			h.Set("Trailer", trailer)
+		}
+	}
+	if resp.NoBody {
+		// Its Content-Length describes a body that is not sent.
+		w.OmitBody()
+	}
+	err := w.WriteStatusLine(resp.StatusCode)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if chunked {
+				_, err = w.WriteChunkedBody(buf[:n])
+			} else {
+				_, err = w.WriteBody(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if chunked {
+		return w.WriteTrailers(forwardHeaders(resp.Trailers))
+	}
+	return nil
+}
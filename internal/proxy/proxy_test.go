@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/lucoand/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves h on an ephemeral port and returns its address.
+func startServer(t *testing.T, h server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Listener.Addr().String()
+}
+
+// roundTrip sends raw to addr and reads one response.
+func roundTrip(t *testing.T, addr string, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	var seen *request.Request
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) *server.HandlerError {
+		seen = req
+		reqBody, err := req.ReadBody()
+		if err != nil {
+			return server.BodyError(err)
+		}
+		body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(reqBody)
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("X-Upstream", "yes")
+		h.Set("Keep-Alive", "timeout=5")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+		return nil
+	})
+	front := startServer(t, New(upstream).Handle)
+
+	// Test: Method, target and body are forwarded and the response relayed
+	resp, body := roundTrip(t, front, "POST /submit?x=1 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: close, X-Secret\r\n"+
+		"X-Secret: hidden\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Forwarded-For: 10.0.0.1\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "POST /submit?x=1 hello", body)
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+
+	// Test: Hop-by-hop fields are stripped and forwarding fields added
+	require.NotNil(t, seen)
+	assert.Equal(t, "example.com", seen.Headers.Get("host"))
+	assert.Empty(t, seen.Headers.Get("x-secret"))
+	assert.Empty(t, seen.Headers.Get("keep-alive"))
+	assert.Equal(t, "close", seen.Headers.Get("connection"))
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", seen.Headers.Get("x-forwarded-for"))
+	assert.Equal(t, `for=127.0.0.1;host="example.com";proto=http`, seen.Headers.Get("forwarded"))
+}
+
+func TestReverseProxyRechunks(t *testing.T) {
+	// Test: A chunked upstream body is re-chunked with its trailers
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetChunkedHeaders("X-Checksum")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first "))
+		w.WriteChunkedBody([]byte("second"))
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+		return nil
+	})
+	front := startServer(t, New(upstream).Handle)
+
+	resp, body := roundTrip(t, front, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "first second", body)
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestReverseProxyChunkedRequest(t *testing.T) {
+	// Test: A chunked request body is streamed upstream with its trailers
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) *server.HandlerError {
+		body, err := req.ReadBody()
+		if err != nil {
+			return server.BodyError(err)
+		}
+		reply := string(body) + " " + req.Trailers.Get("X-Checksum")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(reply)))
+		w.WriteBody([]byte(reply))
+		return nil
+	})
+	front := startServer(t, New(upstream).Handle)
+
+	resp, body := roundTrip(t, front, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"5\r\nhello\r\n"+
+		"6\r\n world\r\n"+
+		"0\r\n"+
+		"X-Checksum: abc\r\n"+
+		"\r\n")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello world abc", body)
+}
+
+func TestReverseProxyBodyless(t *testing.T) {
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) *server.HandlerError {
+		if req.RequestLine.RequestTarget == "/cached" {
+			w.WriteStatusLine(response.StatusNotModified)
+			w.WriteHeaders(response.GetDefaultHeaders(42))
+			return nil
+		}
+		w.OmitBody()
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(42))
+		return nil
+	})
+	front := startServer(t, New(upstream).Handle)
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Test: A HEAD response keeps its Content-Length and the connection
+	_, err = conn.Write([]byte("HEAD /file HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(42), resp.ContentLength)
+	assert.False(t, resp.Close)
+
+	// Test: So does a 304 on the same connection
+	_, err = conn.Write([]byte("GET /cached HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, "42", resp.Header.Get("Content-Length"))
+	assert.False(t, resp.Close)
+}
+
+func TestReverseProxyUpstreamDown(t *testing.T) {
+	// Test: An unreachable upstream is answered with 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	front := startServer(t, New(addr).Handle)
+
+	resp, _ := roundTrip(t, front, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 502, resp.StatusCode)
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/response"
+)
+
+// maxUpstreamHeaderBytes bounds the status line and header section of an
+// upstream response.
+const maxUpstreamHeaderBytes = 1 << 20
+
+// upstreamResponse is a response read from the upstream connection. Body
+// yields the decoded body; Trailers is filled once a chunked Body has been
+// read to EOF.
+type upstreamResponse struct {
+	StatusCode response.StatusCode
+	Headers    *headers.Headers
+	Trailers   *headers.Headers
+	Body       io.Reader
+	// ContentLength is the framed body length, or -1 if it is chunked or
+	// delimited by the connection closing.
+	ContentLength int
+	// NoBody is set for responses that never carry a body, such as the
+	// answer to HEAD, even if their headers describe one.
+	NoBody bool
+}
+
+// readLine reads a CRLF (or bare LF) terminated line, charging its length
+// against *budget.
+func readLine(br *bufio.Reader, budget *int) (string, error) {
+	line, err := br.ReadString('\n')
+	*budget -= len(line)
+	if *budget < 0 {
+		return "", fmt.Errorf("Upstream header section too large")
+	}
+	if err != nil {
+		return "", err
+	}
+	return line, nil
+}
+
+// readFields parses header fields until the empty line ending the section.
+func readFields(br *bufio.Reader, h *headers.Headers, budget *int) error {
+	for {
+		line, err := readLine(br, budget)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(line, headers.CRLF) {
+			line = strings.TrimSuffix(line, "\n") + headers.CRLF
+		}
+		_, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func parseStatusLine(line string) (response.StatusCode, error) {
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") {
+		return 0, fmt.Errorf("Malformed upstream status line %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 {
+		return 0, fmt.Errorf("Malformed upstream status code %q", parts[1])
+	}
+	return response.StatusCode(code), nil
+}
+
+// readResponse reads the next final response from br, skipping any 1xx
+// interim responses. method is the request method, as HEAD responses
+// carry no body.
+func readResponse(br *bufio.Reader, method string) (*upstreamResponse, error) {
+	budget := maxUpstreamHeaderBytes
+	for {
+		line, err := readLine(br, &budget)
+		if err != nil {
+			return nil, err
+		}
+		code, err := parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		resp := &upstreamResponse{
+			StatusCode:    code,
+			Headers:       headers.NewHeaders(),
+			Trailers:      headers.NewHeaders(),
+			ContentLength: -1,
+		}
+		err = readFields(br, resp.Headers, &budget)
+		if err != nil {
+			return nil, err
+		}
+		if code >= 100 && code < 200 && code != response.StatusSwitchingProtocols {
+			continue
+		}
+		err = resp.frameBody(br, method)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// frameBody picks how the body is delimited, per RFC 9112 section 6.3.
+func (resp *upstreamResponse) frameBody(br *bufio.Reader, method string) error {
+	code := resp.StatusCode
+	if method == "HEAD" || (code >= 100 && code < 200) ||
+		code == response.StatusNoContent || code == response.StatusNotModified {
+		resp.Body = strings.NewReader("")
+		resp.ContentLength = 0
+		resp.NoBody = true
+		return nil
+	}
+	if resp.Headers.Get("transfer-encoding") != "" {
+		if !isChunked(resp.Headers) {
+			resp.Body = br
+			return nil
+		}
+		resp.Body = &chunkedReader{br: br, trailers: resp.Trailers}
+		return nil
+	}
+	if v := resp.Headers.Get("content-length"); v != "" {
+		length, err := strconv.Atoi(v)
+		if err != nil || length < 0 {
+			return fmt.Errorf("Invalid upstream content-length %q", v)
+		}
+		resp.ContentLength = length
+		resp.Body = &exactReader{r: io.LimitReader(br, int64(length)), remaining: length}
+		return nil
+	}
+	resp.Body = br
+	return nil
+}
+
+func isChunked(h *headers.Headers) bool {
+	codings := strings.Split(h.Get("transfer-encoding"), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// exactReader reports io.ErrUnexpectedEOF if the body ends before its
+// Content-Length.
+type exactReader struct {
+	r         io.Reader
+	remaining int
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.remaining -= n
+	if errors.Is(err, io.EOF) && e.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body, collecting its trailer fields.
+type chunkedReader struct {
+	br        *bufio.Reader
+	trailers  *headers.Headers
+	remaining int64
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		budget := maxUpstreamHeaderBytes
+		line, err := readLine(c.br, &budget)
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		sizeField := strings.TrimRight(line, "\r\n")
+		if i := strings.IndexByte(sizeField, ';'); i != -1 {
+			sizeField = sizeField[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("Invalid upstream chunk size %q", sizeField)
+		}
+		if size == 0 {
+			c.done = true
+			err = readFields(c.br, c.trailers, &budget)
+			if err != nil {
+				return 0, unexpected(err)
+			}
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= int64(n)
+	if err != nil {
+		return n, unexpected(err)
+	}
+	if c.remaining == 0 {
+		crlf := make([]byte, 2)
+		_, err = io.ReadFull(c.br, crlf)
+		if err != nil {
+			return n, unexpected(err)
+		}
+		if string(crlf) != headers.CRLF {
+			return n, fmt.Errorf("Upstream chunk data not terminated by CRLF")
+		}
+	}
+	return n, nil
+}
+
+// unexpected turns io.EOF in the middle of a chunked body into
+// io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package request
+
+import (
+	"fmt"
+	"io"
+)
+
+// bodyReader decodes a request body from the connection as it is read,
+// honoring Content-Length or chunked framing.
+type bodyReader struct {
+	p      *parser
+	r      *Request
+	closed bool
+}
+
+func (r *Request) appendBody(data []byte) {
+	r.pending = append(r.pending, data...)
+	r.bodyRead += len(data)
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("Read on closed request body")
+	}
+	for len(b.r.pending) == 0 && b.r.state != requestStateDone {
+		err := b.p.step(b.r)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(b.r.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.r.pending)
+	b.r.pending = b.r.pending[n:]
+	return n, nil
+}
+
+func (b *bodyReader) Close() error {
+	b.closed = true
+	return nil
+}
+
+// discardBody consumes whatever is left of r's body so that p is positioned
+// at the start of the next request on the connection.
+func (r *Request) discardBody(p *parser) error {
+	for r.state != requestStateDone {
+		err := p.step(r)
+		if err != nil {
+			return err
+		}
+		r.pending = r.pending[:0]
+	}
+	r.pending = nil
+	return nil
+}
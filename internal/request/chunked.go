@@ -0,0 +1,163 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+)
+
+// maxChunkSizeDigits keeps a chunk-size line from overflowing an int64.
+const maxChunkSizeDigits = 15
+
+// maxChunkLineBytes bounds a chunk-size line including its extensions.
+const maxChunkLineBytes = 4096
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') && !(r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// isChunked reports whether the request body uses the chunked transfer
+// coding, which per RFC 9112 must be the final coding applied.
+func (r *Request) isChunked() bool {
+	te := r.Headers.Get("transfer-encoding")
+	if te == "" {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	last := strings.TrimSpace(codings[len(codings)-1])
+	return strings.EqualFold(last, "chunked")
+}
+
+// parseChunkSize consumes a chunk-size line, discarding any chunk
+// extensions. A size of zero marks the last chunk.
+func (r *Request) parseChunkSize(data []byte) (int, error) {
+	idx := bytes.Index(data, []byte(headers.CRLF))
+	if idx == -1 {
+		if len(data) > maxChunkLineBytes {
+			return 0, fmt.Errorf("Chunk-size line too long")
+		}
+		return 0, nil
+	}
+	line := string(data[:idx])
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	line = strings.TrimRight(line, " \t")
+	if !isHex(line) || len(line) > maxChunkSizeDigits {
+		return 0, fmt.Errorf("Invalid chunk size: %q", line)
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid chunk size: %q", line)
+	}
+	if size == 0 {
+		r.state = requestStateParsingTrailers
+	} else {
+		err = r.checkBody(int64(r.bodyRead) + size)
+		if err != nil {
+			return 0, err
+		}
+		r.chunkRemaining = size
+		r.state = requestStateParsingChunkData
+	}
+	return idx + 2, nil
+}
+
+func (r *Request) parseChunkData(data []byte) (int, error) {
+	n := int64(len(data))
+	if n > r.chunkRemaining {
+		n = r.chunkRemaining
+	}
+	r.appendBody(data[:n])
+	r.chunkRemaining -= n
+	if r.chunkRemaining == 0 {
+		r.state = requestStateParsingChunkDataEnd
+	}
+	return int(n), nil
+}
+
+func (r *Request) parseChunkDataEnd(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	if string(data[:2]) != headers.CRLF {
+		return 0, fmt.Errorf("Chunk data not terminated by CRLF")
+	}
+	r.state = requestStateParsingChunkSize
+	return 2, nil
+}
+
+// forbiddenTrailers lists fields that must not be taken from a trailer
+// section because they affect framing, routing or authentication.
+var forbiddenTrailers = map[string]bool{
+	"transfer-encoding": true,
+	"content-length":    true,
+	"host":              true,
+	"trailer":           true,
+	"content-encoding":  true,
+	"content-type":      true,
+	"content-range":     true,
+	"authorization":     true,
+	"cache-control":     true,
+	"expect":            true,
+	"te":                true,
+}
+
+// parseTrailers reads the trailer section that follows the last chunk into
+// r.Trailers.
+func (r *Request) parseTrailers(data []byte) (int, error) {
+	n, done, err := r.Trailers.ParseWithPolicy(data, r.headerPolicy)
+	if err != nil {
+		return 0, err
+	}
+	pendingLen := 0
+	if n == 0 && !done {
+		pendingLen = len(data)
+	}
+	err = r.checkFieldSection(n, done, pendingLen)
+	if err != nil {
+		return 0, err
+	}
+	if done {
+		r.filterTrailers()
+		r.state = requestStateDone
+	}
+	return n, nil
+}
+
+// filterTrailers drops trailer fields that are forbidden and, when the
+// request announced its trailers with a Trailer header, any field that was
+// not announced.
+func (r *Request) filterTrailers() {
+	announced := map[string]bool{}
+	announcement := r.Headers.Get("trailer")
+	for _, name := range strings.Split(announcement, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			announced[name] = true
+		}
+	}
+	// Fields are deleted in place rather than copied, so that a shallow copy
+	// made by WithContext before the body was read sees the same trailers.
+	var dropped []string
+	for name := range r.Trailers.All() {
+		key := strings.ToLower(name)
+		if forbiddenTrailers[key] || (announcement != "" && !announced[key]) {
+			dropped = append(dropped, name)
+		}
+	}
+	for _, name := range dropped {
+		r.Trailers.Del(name)
+	}
+}
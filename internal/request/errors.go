@@ -0,0 +1,51 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+)
+
+// Errors returned while parsing a request wrap one of these, so callers
+// can tell what kind of response a failure deserves with errors.Is.
+var (
+	ErrMalformedRequestLine = errors.New("malformed request-line")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP version")
+	ErrMalformedHeader      = errors.New("malformed header field")
+	ErrMalformedBody        = errors.New("malformed or incomplete body")
+)
+
+// Framing errors reject requests whose body boundaries could be read
+// differently by another server on the path, the basis of request
+// smuggling. They are wrapped in ErrMalformedHeader.
+var (
+	ErrTransferEncodingWithContentLength = errors.New("both Transfer-Encoding and Content-Length present")
+	ErrConflictingContentLength          = errors.New("differing Content-Length values")
+	ErrChunkedNotFinal                   = errors.New("chunked is not the final transfer coding")
+	ErrWhitespaceBeforeColon             = headers.ErrWhitespaceBeforeColon
+)
+
+// classify wraps err with the sentinel for the part of the request that was
+// being parsed when it occurred, unless it is already classified.
+func (r *Request) classify(err error) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) ||
+		errors.Is(err, ErrMalformedRequestLine) ||
+		errors.Is(err, ErrUnsupportedVersion) ||
+		errors.Is(err, ErrMalformedHeader) ||
+		errors.Is(err, ErrMalformedBody) {
+		return err
+	}
+	switch r.state {
+	case requestStateInitialized:
+		return fmt.Errorf("%w: %w", ErrMalformedRequestLine, err)
+	case requestStateParsingHeaders, requestStateParsingTrailers:
+		return fmt.Errorf("%w: %w", ErrMalformedHeader, err)
+	case requestStateParsingBody, requestStateParsingChunkSize,
+		requestStateParsingChunkData, requestStateParsingChunkDataEnd:
+		return fmt.Errorf("%w: %w", ErrMalformedBody, err)
+	default:
+		return err
+	}
+}
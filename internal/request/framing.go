@@ -0,0 +1,72 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkFraming decides how the body is delimited once the headers are
+// parsed, rejecting the ambiguous combinations used to smuggle a second
+// request past a proxy that frames the message differently (RFC 9112
+// section 6.3).
+func (r *Request) checkFraming() error {
+	te := r.Headers.Values("transfer-encoding")
+	cl := r.Headers.Values("content-length")
+	if len(te) > 0 && len(cl) > 0 {
+		return ErrTransferEncodingWithContentLength
+	}
+	if len(te) > 0 {
+		return checkTransferCodings(te)
+	}
+	length, err := parseContentLength(cl)
+	if err != nil {
+		return err
+	}
+	r.contentLength = length
+	return nil
+}
+
+// checkTransferCodings requires chunked to be applied exactly once, as the
+// final coding, since otherwise the end of the body cannot be found.
+func checkTransferCodings(values []string) error {
+	var codings []string
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			codings = append(codings, strings.TrimSpace(coding))
+		}
+	}
+	for i, coding := range codings {
+		if strings.EqualFold(coding, "chunked") && i != len(codings)-1 {
+			return ErrChunkedNotFinal
+		}
+	}
+	if !strings.EqualFold(codings[len(codings)-1], "chunked") {
+		return ErrChunkedNotFinal
+	}
+	return nil
+}
+
+// parseContentLength returns the length given by the Content-Length
+// values, or -1 if there are none. Repeated values, as separate fields or a
+// list, are accepted only if they are all the same.
+func parseContentLength(values []string) (int64, error) {
+	length := int64(-1)
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" || strings.Trim(item, "0123456789") != "" {
+				return 0, fmt.Errorf("Invalid content-length value %q", item)
+			}
+			n, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid content-length value %q", item)
+			}
+			if length != -1 && n != length {
+				return 0, ErrConflictingContentLength
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
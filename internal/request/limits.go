@@ -0,0 +1,96 @@
+package request
+
+import (
+	"fmt"
+)
+
+// Limits caps how large a request may grow while it is parsed. A zero
+// field means no limit.
+type Limits struct {
+	// MaxRequestLineBytes bounds the request line, excluding its CRLF.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes bounds the header section, and separately the trailer
+	// section, including line endings.
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of header fields, and separately the
+	// number of trailer fields.
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the decoded body.
+	MaxBodyBytes int
+}
+
+type LimitKind int
+
+const (
+	LimitRequestLine LimitKind = iota
+	LimitHeaderBytes
+	LimitHeaderCount
+	LimitBody
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitRequestLine:
+		return "request-line length"
+	case LimitHeaderBytes:
+		return "header size"
+	case LimitHeaderCount:
+		return "header count"
+	case LimitBody:
+		return "body size"
+	default:
+		return "unknown limit"
+	}
+}
+
+// LimitError is returned when a request exceeds one of its Limits.
+type LimitError struct {
+	Kind LimitKind
+	Max  int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Request exceeds maximum %s of %d", e.Kind, e.Max)
+}
+
+func exceeds(value int, max int) bool {
+	return max > 0 && value > max
+}
+
+// checkRequestLine rejects a request line that is already longer than
+// allowed, whether or not its CRLF has arrived yet.
+func (r *Request) checkRequestLine(lineLen int) error {
+	if exceeds(lineLen, r.limits.MaxRequestLineBytes) {
+		return &LimitError{Kind: LimitRequestLine, Max: r.limits.MaxRequestLineBytes}
+	}
+	return nil
+}
+
+// checkFieldSection accounts for n more bytes of a header or trailer
+// section, plus one more field unless the section just ended. pendingLen
+// is the length of an incomplete line still waiting for its CRLF.
+func (r *Request) checkFieldSection(n int, done bool, pendingLen int) error {
+	r.fieldBytes += n
+	if n > 0 && !done {
+		r.fieldCount++
+	}
+	if exceeds(r.fieldBytes+pendingLen, r.limits.MaxHeaderBytes) {
+		return &LimitError{Kind: LimitHeaderBytes, Max: r.limits.MaxHeaderBytes}
+	}
+	if exceeds(r.fieldCount, r.limits.MaxHeaderCount) {
+		return &LimitError{Kind: LimitHeaderCount, Max: r.limits.MaxHeaderCount}
+	}
+	if done {
+		r.fieldBytes = 0
+		r.fieldCount = 0
+	}
+	return nil
+}
+
+func (r *Request) checkBody(length int64) error {
+	max := int64(r.limits.MaxBodyBytes)
+	if max > 0 && length > max {
+		return &LimitError{Kind: LimitBody, Max: r.limits.MaxBodyBytes}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// parser owns the read buffer for a request, feeding bytes from the
+// underlying reader into the request state machine.
+type parser struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	eof         bool
+}
+
+func newParser(reader io.Reader) *parser {
+	return &parser{
+		reader: reader,
+		buf:    make([]byte, bufferSize, bufferSize),
+	}
+}
+
+// step advances r by parsing buffered data, and reads from the underlying
+// reader only when the buffered data cannot make progress on its own.
+func (p *parser) step(r *Request) error {
+	state := r.state
+	numParsed, err := r.parse(p.buf[:p.readToIndex])
+	if err != nil {
+		return err
+	}
+	if numParsed > 0 {
+		copy(p.buf, p.buf[numParsed:p.readToIndex])
+		p.readToIndex -= numParsed
+		return nil
+	}
+	if r.state != state {
+		return nil
+	}
+	if p.eof {
+		if r.state == requestStateInitialized && p.readToIndex == 0 {
+			return io.EOF
+		}
+		return r.classify(fmt.Errorf("Parsing finished unexpectedly - incomplete request"))
+	}
+	return p.fill()
+}
+
+// fill reads once from the underlying reader, doubling the buffer first
+// if it is already full.
+func (p *parser) fill() error {
+	if len(p.buf) <= p.readToIndex {
+		temp := make([]byte, len(p.buf)*2, cap(p.buf)*2)
+		copy(temp, p.buf)
+		p.buf = temp
+	}
+	numBytesRead, readErr := p.reader.Read(p.buf[p.readToIndex:])
+	if readErr != nil && !errors.Is(readErr, io.EOF) {
+		return readErr
+	}
+	p.readToIndex += numBytesRead
+	if errors.Is(readErr, io.EOF) {
+		p.eof = true
+	}
+	return nil
+}
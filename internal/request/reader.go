@@ -0,0 +1,78 @@
+package request
+
+import (
+	"io"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+)
+
+// Reader reads successive requests from a single connection. Bytes read
+// past the end of one request are kept for the next, so a Reader must be
+// used for the lifetime of the connection rather than one per request.
+type Reader struct {
+	// Limits is applied to every request read after it is set.
+	Limits Limits
+	// HeaderPolicy selects how obsolete syntax in header and trailer
+	// values is treated.
+	HeaderPolicy headers.Policy
+	p            *parser
+	prev         *Request
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{p: newParser(reader)}
+}
+
+// Wait blocks until at least one byte of the next request is available,
+// returning io.EOF if the peer closed the connection cleanly first.
+func (rr *Reader) Wait() error {
+	for rr.p.readToIndex == 0 {
+		if rr.p.eof {
+			return io.EOF
+		}
+		err := rr.p.fill()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRequest parses the next request, reading the whole body into r.Body.
+// It returns io.EOF if the connection was closed before any bytes of a new
+// request arrived.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	r, err := rr.StreamRequest()
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// StreamRequest parses the next request line and headers, leaving the body
+// to be read through r.BodyReader. Whatever the caller left unread of the
+// previous request's body is discarded first.
+func (rr *Reader) StreamRequest() (*Request, error) {
+	if rr.prev != nil {
+		err := rr.prev.discardBody(rr.p)
+		if err != nil {
+			return nil, err
+		}
+		rr.prev = nil
+	}
+	r := newRequest(rr.Limits)
+	r.headerPolicy = rr.HeaderPolicy
+	for r.state == requestStateInitialized || r.state == requestStateParsingHeaders {
+		err := rr.p.step(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.BodyReader = &bodyReader{p: rr.p, r: r}
+	rr.prev = r
+	return r, nil
+}
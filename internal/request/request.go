@@ -1,10 +1,9 @@
 package request
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 
 	"github.com/lucoand/httpfromtcp/internal/headers"
@@ -14,13 +13,53 @@ const requestStateInitialized int = 0
 const requestStateParsingHeaders int = 1
 const requestStateParsingBody int = 2
 const requestStateDone int = 3
+const requestStateParsingChunkSize int = 4
+const requestStateParsingChunkData int = 5
+const requestStateParsingChunkDataEnd int = 6
+const requestStateParsingTrailers int = 7
 const bufferSize = 8
 
 type Request struct {
-	Headers     headers.Headers
+	Headers     *headers.Headers
 	RequestLine RequestLine
-	Body        []byte
-	state       int
+	// Target is the parsed RequestLine.RequestTarget.
+	Target Target
+	Body   []byte
+	// BodyReader streams the decoded body. For requests returned by
+	// RequestFromReader it has already been drained into Body.
+	BodyReader io.ReadCloser
+	// Trailers holds trailer fields received after the last chunk of a
+	// chunked body.
+	Trailers *headers.Headers
+	// RemoteAddr is the client's "host:port", set by the server package.
+	RemoteAddr string
+	// Params holds the path parameters extracted by a router, keyed by
+	// name.
+	Params map[string]string
+
+	ctx context.Context
+	// parseProgress is shared by the shallow copies WithContext makes, so
+	// that reading the body through any of them advances them all.
+	*parseProgress
+}
+
+// parseProgress is how far parsing of a request has got.
+type parseProgress struct {
+	state int
+	// bytes still expected from the chunk currently being decoded
+	chunkRemaining int64
+	// decoded body bytes not yet handed out by BodyReader
+	pending  []byte
+	bodyRead int
+	// contentLength is the Content-Length of the body, or -1 if there is
+	// none
+	contentLength int64
+	limits        Limits
+	// headerPolicy is how obsolete value syntax is parsed
+	headerPolicy headers.Policy
+	// size of the header or trailer section parsed so far
+	fieldBytes int
+	fieldCount int
 }
 
 type RequestLine struct {
@@ -41,12 +80,50 @@ func (r *Request) Print() {
 	r.Headers.Print()
 	fmt.Println("Body:")
 	fmt.Printf("%s\n", r.Body)
+	if r.Trailers.Len() > 0 {
+		fmt.Println("Trailers:")
+		for k, v := range r.Trailers.All() {
+			fmt.Printf("- %s: %s\n", k, v)
+		}
+	}
+}
+
+// Context returns the request's context. For requests served by the server
+// package it is cancelled when the client disconnects, the handler returns
+// or the server shuts down.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
-func newRequest() *Request {
+// Param returns the path parameter name, or "" if the request has none by
+// that name.
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+func newRequest(limits Limits) *Request {
 	return &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		parseProgress: &parseProgress{
+			state:  requestStateInitialized,
+			limits: limits,
+			// no Content-Length until the headers say otherwise
+			contentLength: -1,
+		},
 	}
 }
 
@@ -59,6 +136,14 @@ func isUpper(s string) bool {
 	return true
 }
 
+// isHTTPVersion reports whether s has the form HTTP/DIGIT.DIGIT.
+func isHTTPVersion(s string) bool {
+	if len(s) != len("HTTP/1.1") || !strings.HasPrefix(s, "HTTP/") {
+		return false
+	}
+	return s[5] >= '0' && s[5] <= '9' && s[6] == '.' && s[7] >= '0' && s[7] <= '9'
+}
+
 // func isDigit(s string) bool {
 // 	for _, r := range s {
 // 		if r < '0' || r > '9' {
@@ -69,6 +154,14 @@ func isUpper(s string) bool {
 // }
 
 func (r *Request) parseSingle(dataString string) (int, error) {
+	lineLen := strings.Index(dataString, "\r\n")
+	if lineLen == -1 {
+		lineLen = len(dataString)
+	}
+	err := r.checkRequestLine(lineLen)
+	if err != nil {
+		return 0, err
+	}
 	requestLine, n, err := parseRequestLine(dataString)
 	if err != nil {
 		return 0, err
@@ -76,55 +169,88 @@ func (r *Request) parseSingle(dataString string) (int, error) {
 	if n == 0 {
 		return 0, nil
 	}
+	target, err := parseTarget(requestLine.Method, requestLine.RequestTarget)
+	if err != nil {
+		return 0, err
+	}
 	r.RequestLine = requestLine
+	r.Target = target
 	r.state = requestStateParsingHeaders
 	// fmt.Println("Request Line Parsed - Now parsing Headers")
 	return n, nil
 }
 
 func (r *Request) parseHeaders(data []byte) (int, error) {
-	n, done, err := r.Headers.Parse(data)
+	n, done, err := r.Headers.ParseWithPolicy(data, r.headerPolicy)
+	if err != nil {
+		return 0, err
+	}
+	pendingLen := 0
+	if n == 0 && !done {
+		pendingLen = len(data)
+	}
+	err = r.checkFieldSection(n, done, pendingLen)
 	if err != nil {
 		return 0, err
 	}
 	if done {
-		// fmt.Println("Headers Parsed - Now parsing body")
-		// fmt.Printf("Content Length inside of parseHeaders(): %v\n", r.Headers.Get("content-length"))
-		r.state = requestStateParsingBody
+		err = r.checkFraming()
+		if err != nil {
+			return 0, err
+		}
+		// A declared length over the limit is rejected now, before anyone
+		// starts reading the body.
+		err = r.checkBody(r.contentLength)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case r.isChunked():
+			r.state = requestStateParsingChunkSize
+		case r.contentLength > 0:
+			r.state = requestStateParsingBody
+		default:
+			r.state = requestStateDone
+		}
 	}
 	return n, nil
 }
 
 func (r *Request) parseBody(data []byte) (int, error) {
-	v := r.Headers.Get("content-length")
-	// fmt.Printf("Content-Length: %s\n", v)
-	if v == "" {
+	length := r.contentLength
+	if length <= 0 {
 		r.state = requestStateDone
 		return 0, nil
 	}
-	length, err := strconv.Atoi(v)
+	err := r.checkBody(length)
 	if err != nil {
 		return 0, err
 	}
-	if length == 0 {
-		r.state = requestStateDone
-		return 0, nil
-	}
 	if len(data) == 0 {
-		return 0, fmt.Errorf("attempted to add empty data slice to body")
+		return 0, nil
 	}
-	r.Body = append(r.Body, data...)
-	if len(r.Body) > length {
-		return 0, fmt.Errorf("Body length exceeds content-length header value")
+	// Anything past content-length belongs to whatever follows this request
+	// on the connection, so leave it unconsumed.
+	remaining := length - int64(r.bodyRead)
+	if int64(len(data)) > remaining {
+		data = data[:remaining]
 	}
-	if len(r.Body) == length {
+	r.appendBody(data)
+	if int64(r.bodyRead) == length {
 		r.state = requestStateDone
-		fmt.Println("Consumed entire length of data given")
 	}
 	return len(data), nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
+	n, err := r.parseState(data)
+	if err != nil {
+		return 0, r.classify(err)
+	}
+	return n, nil
+}
+
+func (r *Request) parseState(data []byte) (int, error) {
 	switch r.state {
 	case requestStateInitialized:
 		// fmt.Println("Parsing Request Line")
@@ -136,6 +262,14 @@ func (r *Request) parse(data []byte) (int, error) {
 	case requestStateParsingBody:
 		// fmt.Println("Parsing body:")
 		return r.parseBody(data)
+	case requestStateParsingChunkSize:
+		return r.parseChunkSize(data)
+	case requestStateParsingChunkData:
+		return r.parseChunkData(data)
+	case requestStateParsingChunkDataEnd:
+		return r.parseChunkDataEnd(data)
+	case requestStateParsingTrailers:
+		return r.parseTrailers(data)
 	case requestStateDone:
 		return 0, fmt.Errorf("Error: trying to read data in a done state")
 	default:
@@ -163,8 +297,11 @@ func parseRequestLine(dataString string) (RequestLine, int, error) {
 	}
 
 	version := parts[2]
-	if version != "HTTP/1.1" {
-		return RequestLine{}, 0, fmt.Errorf("Unsupported HTTP version. Currently only HTTP/1.1 is supported.")
+	if !isHTTPVersion(version) {
+		return RequestLine{}, 0, fmt.Errorf("Malformed HTTP version %q", version)
+	}
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return RequestLine{}, 0, fmt.Errorf("%w: Currently only HTTP/1.0 and HTTP/1.1 are supported.", ErrUnsupportedVersion)
 	}
 	versionParts := strings.Split(version, "/")
 	target := parts[1]
@@ -175,73 +312,52 @@ func parseRequestLine(dataString string) (RequestLine, int, error) {
 	}, len(lines[0]) + 2, nil
 }
 
+// RequestFromReader parses a complete request, reading the whole body into
+// r.Body before returning. Any bytes read past the end of the request are
+// discarded; use a Reader to parse several requests from one connection.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	r := newRequest()
-	readToIndex := 0
-	numParsed := 0
-	for r.state != requestStateDone {
-		if len(buf) <= readToIndex {
-			temp := make([]byte, len(buf)*2, cap(buf)*2)
-			copy(temp, buf)
-			buf = temp
-		}
-		numBytesRead, readErr := reader.Read(buf[readToIndex:])
-		if readErr != nil && !errors.Is(readErr, io.EOF) {
-			return nil, readErr
-		}
-		readToIndex += numBytesRead
-		for _, c := range buf[:numBytesRead] {
-			if c == '\r' {
-				fmt.Print("\\r")
-			} else if c == '\n' {
-				fmt.Print("\\n")
-			} else {
-				fmt.Printf("%c", c)
-			}
-		}
-		fmt.Println()
-		// if errors.Is(readErr, io.EOF) && !strings.Contains(string(buf[:readToIndex]), "\n") && r.state != requestStateParsingBody {
-		// 	break
-		// }
-		var err error = nil
-		numParsed, err = r.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
-		}
-		if errors.Is(readErr, io.EOF) && numParsed == 0 {
-			break
-		}
-		if numParsed == 0 {
-			continue
-		}
-		temp := make([]byte, len(buf), cap(buf))
-		copy(temp, buf[numParsed:])
-		buf = temp
-		readToIndex -= numParsed
-	}
-	if r.state != requestStateDone {
-		// if r.state == requestStateInitialized {
-		// 	fmt.Println("Request State= initialized")
-		// }
-		// if r.state == requestStateParsingHeaders {
-		// 	fmt.Println("Request State= parsing headers")
-		// }
-		return nil, fmt.Errorf("Parsing finished unexpectedly - incomplete request")
-	}
-	// fmt.Printf("Request line:\n")
-	// fmt.Printf("Method: %s\n", r.RequestLine.Method)
-	// fmt.Printf("Target: %s\n", r.RequestLine.RequestTarget)
-	// fmt.Printf("Version: %s\n", r.RequestLine.HttpVersion)
-	// fmt.Printf("Headers:\n")
-	// for key, value := range r.Headers {
-	// 	fmt.Printf("%s: %s\n", key, value)
-	// }
-	// fmt.Println()
-	// fmt.Println("----------------")
-	// fmt.Println("Parsing complete")
-	// r.Headers.Print()
-	// fmt.Printf("%s\n", r.Body)
-	// fmt.Println("----------------")
-	return r, nil
+	return NewReader(reader).ReadRequest()
+}
+
+// StreamRequestFromReader parses the request line and headers and returns
+// as soon as they are complete. The body is left on the reader and is
+// decoded on demand through r.BodyReader; Trailers are only populated once
+// the body has been read to EOF.
+func StreamRequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).StreamRequest()
+}
+
+// BodyConsumed reports whether the body, and any trailers, have been read
+// in full from the underlying reader, so that nothing more of this request
+// will be read from it. It is true from the start for a request without a
+// body.
+func (r *Request) BodyConsumed() bool {
+	return r.parseProgress == nil || r.state == requestStateDone
+}
+
+// BodyRemaining returns how many body bytes are still to be read from the
+// underlying reader, or -1 if that is not known because the body is
+// chunked.
+func (r *Request) BodyRemaining() int64 {
+	switch {
+	case r.BodyConsumed():
+		return 0
+	case r.isChunked():
+		return -1
+	default:
+		return r.contentLength - int64(r.bodyRead)
+	}
+}
+
+// ReadBody reads whatever is left of the body into r.Body and returns it.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.BodyReader == nil {
+		return r.Body, nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = append(r.Body, body...)
+	return r.Body, nil
 }
@@ -1,9 +1,11 @@
 package request
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -270,3 +272,619 @@ func TestParseBody(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, 0, len(r.Body))
 }
+
+func TestParseChunkedBody(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Chunk extensions and uppercase hex sizes
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A;name=value\r\n0123456789\r\n" +
+			"1 ; ext\r\n!\r\n" +
+			"0;last\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", string(r.Body))
+
+	// Test: Chunked is the final coding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: gzip, Chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "abc", string(r.Body))
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, 0, len(r.Body))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	require.Nil(t, r)
+
+	// Test: Chunk data longer than chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	require.Nil(t, r)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	require.Nil(t, r)
+}
+
+func TestParseTrailers(t *testing.T) {
+	// Test: Announced trailer
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+	assert.Equal(t, "", r.Headers.Get("x-checksum"))
+
+	// Test: Unannounced and forbidden trailers are dropped
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum, Content-Length\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"X-Other: nope\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+	assert.Equal(t, "", r.Trailers.Get("X-Other"))
+	assert.Equal(t, "", r.Trailers.Get("Content-Length"))
+
+	// Test: Trailers without a Trailer announcement are kept
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+
+	// Test: Malformed trailer
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"X-Checksum abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+	require.Nil(t, r)
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	// Test: Headers are returned without touching the body
+	head := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := StreamRequestFromReader(io.MultiReader(head, brokenReader{}))
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, "13", r.Headers.Get("Content-Length"))
+	_, err = io.ReadAll(r.BodyReader)
+	require.Error(t, err)
+
+	// Test: Content-Length body read on demand
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 4,
+	}
+	r, err = StreamRequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, 0, len(r.Body))
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Chunked body and trailers read on demand
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = StreamRequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "", r.Trailers.Get("X-Checksum"))
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+
+	// Test: Truncated body surfaces an error from the reader
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 20\r\n" +
+			"\r\n" +
+			"partial content\n",
+		numBytesPerRead: 3,
+	}
+	r, err = StreamRequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.Error(t, err)
+
+	// Test: Reading a closed body fails
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = StreamRequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(make([]byte, 5))
+	require.Error(t, err)
+
+	// Test: BodyRemaining counts what has not arrived of a Content-Length
+	// body
+	r, err = StreamRequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), r.BodyRemaining())
+	_, err = io.ReadFull(r.BodyReader, make([]byte, 4))
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), r.BodyRemaining())
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), r.BodyRemaining())
+
+	// Test: The rest of a chunked body is unknown until it ends
+	r, err = StreamRequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.BodyRemaining())
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), r.BodyRemaining())
+}
+
+func TestReaderSuccessiveRequests(t *testing.T) {
+	// Test: Leftover bytes are kept for the next request
+	reader := &chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"POST /third HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, 0, len(r.Body))
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+
+	// Test: Clean close between requests reports io.EOF
+	r, err = rr.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+	require.Nil(t, r)
+	require.ErrorIs(t, rr.Wait(), io.EOF)
+
+	// Test: Close in the middle of a request is not io.EOF
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local",
+		numBytesPerRead: 7,
+	}
+	rr = NewReader(reader)
+	require.NoError(t, rr.Wait())
+	r, err = rr.ReadRequest()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, io.EOF)
+	require.Nil(t, r)
+}
+
+func TestReaderPipelinedStreams(t *testing.T) {
+	// Test: Unread streamed bodies are skipped before the next request
+	reader := &chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 11\r\n" +
+			"\r\n" +
+			"ignored0123" +
+			"POST /second HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"4\r\nskip\r\n0\r\n\r\n" +
+			"POST /third HTTP/1.1\r\n" +
+			"Content-Length: 4\r\n" +
+			"\r\n" +
+			"kept",
+		numBytesPerRead: 1024,
+	}
+	rr := NewReader(reader)
+	r, err := rr.StreamRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	_, err = r.BodyReader.Read(make([]byte, 3))
+	require.NoError(t, err)
+	r.BodyReader.Close()
+	r, err = rr.StreamRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	r, err = rr.StreamRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "kept", string(body))
+	_, err = rr.StreamRequest()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestContext(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	// Test: Requests default to a background context
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext leaves the original untouched
+	ctx, cancel := context.WithCancel(context.Background())
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, ctx, r2.Context())
+	assert.Equal(t, context.Background(), r.Context())
+	assert.Equal(t, "/", r2.RequestLine.RequestTarget)
+	cancel()
+	assert.Error(t, r2.Context().Err())
+
+	// Test: A copy made before the body is read shares its progress
+	r, err = StreamRequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n"))
+	require.NoError(t, err)
+	r2 = r.WithContext(context.Background())
+	assert.False(t, r2.BodyConsumed())
+	body, err := r2.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, r2.BodyConsumed())
+	assert.True(t, r.BodyConsumed())
+	assert.Equal(t, "1", r2.Trailers.Get("x-sum"))
+}
+
+func readWithLimits(data string, limits Limits) (*Request, error) {
+	rr := NewReader(&chunkReader{data: data, numBytesPerRead: 4})
+	rr.Limits = limits
+	return rr.ReadRequest()
+}
+
+func TestRequestLimits(t *testing.T) {
+	req := "POST /coffee HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: curl/7.81.0\r\n" +
+		"Content-Length: 13\r\n" +
+		"\r\n" +
+		"hello world!\n"
+	var limitErr *LimitError
+
+	// Test: Request within every limit
+	r, err := readWithLimits(req, Limits{
+		MaxRequestLineBytes: len("POST /coffee HTTP/1.1"),
+		MaxHeaderBytes:      len(req) - len("POST /coffee HTTP/1.1\r\n") - 13,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        13,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Request line too long
+	_, err = readWithLimits(req, Limits{MaxRequestLineBytes: 12})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitRequestLine, limitErr.Kind)
+
+	// Test: Request line too long before its CRLF arrives
+	_, err = readWithLimits("GET /"+strings.Repeat("a", 100), Limits{MaxRequestLineBytes: 32})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitRequestLine, limitErr.Kind)
+
+	// Test: Header section too large
+	_, err = readWithLimits(req, Limits{MaxHeaderBytes: 40})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitHeaderBytes, limitErr.Kind)
+
+	// Test: Single header line too large before its CRLF arrives
+	_, err = readWithLimits("GET / HTTP/1.1\r\nX-Big: "+strings.Repeat("a", 100), Limits{MaxHeaderBytes: 32})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitHeaderBytes, limitErr.Kind)
+
+	// Test: Too many headers
+	_, err = readWithLimits(req, Limits{MaxHeaderCount: 2})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitHeaderCount, limitErr.Kind)
+
+	// Test: Content-Length over the body limit is rejected up front
+	_, err = readWithLimits(req, Limits{MaxBodyBytes: 12})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitBody, limitErr.Kind)
+
+	// Test: Chunked body over the body limit
+	_, err = readWithLimits("POST / HTTP/1.1\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"8\r\n01234567\r\n"+
+		"8\r\n01234567\r\n"+
+		"0\r\n\r\n", Limits{MaxBodyBytes: 10})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitBody, limitErr.Kind)
+
+	// Test: Too many trailers
+	_, err = readWithLimits("POST / HTTP/1.1\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"0\r\n"+
+		"A: 1\r\nB: 2\r\nC: 3\r\n"+
+		"\r\n", Limits{MaxHeaderCount: 2})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitHeaderCount, limitErr.Kind)
+}
+
+func TestParseErrorKinds(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"missing method", "/coffee HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"lowercase method", "get / HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"garbage version", "GET / HTTPS/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"unsupported version", "GET / HTTP/7.8\r\n\r\n", ErrUnsupportedVersion},
+		{"truncated request line", "GET / HT", ErrMalformedRequestLine},
+		{"bad header", "GET / HTTP/1.1\r\nHost localhost\r\n\r\n", ErrMalformedHeader},
+		{"truncated headers", "GET / HTTP/1.1\r\nHost: localhost\r\n", ErrMalformedHeader},
+		{"bad content-length", "POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n0123456789", ErrMalformedHeader},
+		{"short body", "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n01234", ErrMalformedBody},
+		{"bad chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n", ErrMalformedBody},
+		{"bad trailer", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nBad Trailer\r\n\r\n", ErrMalformedHeader},
+	}
+	for _, c := range cases {
+		// Test: Each failure is classified by the part that was malformed
+		_, err := RequestFromReader(&chunkReader{data: c.data, numBytesPerRead: 5})
+		assert.ErrorIs(t, err, c.want, c.name)
+	}
+}
+
+func TestRequestFraming(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"te with cl", "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrTransferEncodingWithContentLength},
+		{"differing cl fields", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 7\r\n\r\nhello12", ErrConflictingContentLength},
+		{"differing cl list", "POST / HTTP/1.1\r\nContent-Length: 5, 7\r\n\r\nhello12", ErrConflictingContentLength},
+		{"chunked not final", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n", ErrChunkedNotFinal},
+		{"chunked twice", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrChunkedNotFinal},
+		{"no chunked", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrChunkedNotFinal},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : localhost\r\n\r\n", ErrWhitespaceBeforeColon},
+		{"tab before colon", "GET / HTTP/1.1\r\nHost\t: localhost\r\n\r\n", ErrWhitespaceBeforeColon},
+	}
+	for _, c := range cases {
+		// Test: Ambiguous framing is rejected with its own error
+		_, err := RequestFromReader(strings.NewReader(c.data))
+		assert.ErrorIs(t, err, c.want, c.name)
+		assert.ErrorIs(t, err, ErrMalformedHeader, c.name)
+	}
+
+	// Test: Identical repeated Content-Length values are accepted
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5, 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: A signed Content-Length is not a length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello"))
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+}
+
+func TestParseHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 requests parse without a Host header
+	r, err := RequestFromReader(strings.NewReader("GET /status HTTP/1.0\r\nUser-Agent: ab\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, "/status", r.RequestLine.RequestTarget)
+
+	// Test: Other well-formed versions are unsupported rather than malformed
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestParseTarget(t *testing.T) {
+	// Test: An origin-form target is split into decoded path and query
+	r, err := RequestFromReader(strings.NewReader("GET /files/a%20b%2Fc?q=go+lang&tag=a&tag=b%26c&empty HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetOrigin, r.Target.Form)
+	assert.Equal(t, "/files/a b/c", r.Target.Path)
+	assert.Equal(t, "/files/a%20b%2Fc", r.Target.RawPath)
+	assert.Equal(t, "q=go+lang&tag=a&tag=b%26c&empty", r.Target.RawQuery)
+	assert.Equal(t, "go lang", r.Target.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, r.Target.Query["tag"])
+	assert.Equal(t, []string{""}, r.Target.Query["empty"])
+	assert.Equal(t, "", r.Target.Query.Get("missing"))
+
+	// Test: An absolute-form target carries the scheme and host
+	r, err = RequestFromReader(strings.NewReader("GET HTTP://example.com:8080?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAbsolute, r.Target.Form)
+	assert.Equal(t, "http", r.Target.Scheme)
+	assert.Equal(t, "example.com:8080", r.Target.Host)
+	assert.Equal(t, "/", r.Target.Path)
+	assert.Equal(t, "1", r.Target.Query.Get("x"))
+
+	// Test: CONNECT takes an authority-form target
+	r, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAuthority, r.Target.Form)
+	assert.Equal(t, "example.com:443", r.Target.Host)
+	assert.Empty(t, r.Target.Path)
+
+	// Test: OPTIONS takes an asterisk-form target
+	r, err = RequestFromReader(strings.NewReader("OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAsterisk, r.Target.Form)
+
+	cases := []struct {
+		name   string
+		target string
+	}{
+		{"bad path escape", "GET /a%zz"},
+		{"truncated path escape", "GET /a%2"},
+		{"bad query escape", "GET /?q=%g1"},
+		{"bad query name escape", "GET /?%=1"},
+		{"asterisk without OPTIONS", "GET *"},
+		{"CONNECT with path", "CONNECT /index.html"},
+		{"CONNECT without port", "CONNECT example.com"},
+		{"relative path", "GET index.html"},
+		{"absolute without host", "GET http:///index.html"},
+		{"non-ASCII", "GET /caf\xc3\xa9"},
+		{"fragment in path", "GET /page#x"},
+		{"fragment after query", "GET /page?q=1#x"},
+		{"CONNECT with fragment", "CONNECT example.com:443#x"},
+	}
+	for _, c := range cases {
+		// Test: Malformed targets are rejected as a malformed request line
+		_, err := RequestFromReader(strings.NewReader(c.target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedRequestLine, c.name)
+	}
+}
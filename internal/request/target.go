@@ -0,0 +1,164 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TargetForm is one of the four forms of request-target in RFC 9112
+// section 3.2.
+type TargetForm int
+
+const (
+	// TargetOrigin is an absolute path with an optional query, as in
+	// "GET /index.html?page=2". It is the usual form.
+	TargetOrigin TargetForm = iota
+	// TargetAbsolute is a full URI, as in "GET http://example.com/ HTTP/1.1",
+	// which clients send to proxies.
+	TargetAbsolute
+	// TargetAuthority is a bare "host:port", used only by CONNECT.
+	TargetAuthority
+	// TargetAsterisk is "*", used only by a server-wide OPTIONS.
+	TargetAsterisk
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case TargetOrigin:
+		return "origin-form"
+	case TargetAbsolute:
+		return "absolute-form"
+	case TargetAuthority:
+		return "authority-form"
+	case TargetAsterisk:
+		return "asterisk-form"
+	default:
+		return "unknown"
+	}
+}
+
+// Target is the parsed request-target of a request.
+type Target struct {
+	Form TargetForm
+	// Scheme is set for the absolute form, and Host for the absolute and
+	// authority forms.
+	Scheme string
+	Host   string
+	// Path is the percent-decoded path, and RawPath the path as sent. Both
+	// are empty for the authority and asterisk forms.
+	Path    string
+	RawPath string
+	// RawQuery is the query as sent, without its "?".
+	RawQuery string
+	// Query holds the decoded query parameters.
+	Query Query
+}
+
+// Query maps each query parameter name to its values, in the order they
+// appeared.
+type Query map[string][]string
+
+// Get returns the first value of the named parameter, or "" if there is
+// none.
+func (q Query) Get(name string) string {
+	values := q[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// parseTarget parses the request-target of a request with the given method.
+// Percent escapes must be well formed, and a fragment is never sent, so "#"
+// is rejected.
+func parseTarget(method string, raw string) (Target, error) {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] <= ' ' || raw[i] >= 0x7f || raw[i] == '#' {
+			return Target{}, fmt.Errorf("Invalid character 0x%02x in request target", raw[i])
+		}
+	}
+	switch {
+	case method == "CONNECT":
+		if strings.ContainsAny(raw, "/?") || !strings.Contains(raw, ":") {
+			return Target{}, fmt.Errorf("CONNECT requires an authority-form target, got %q", raw)
+		}
+		return Target{Form: TargetAuthority, Host: raw}, nil
+	case raw == "*":
+		if method != "OPTIONS" {
+			return Target{}, fmt.Errorf("Asterisk target is only allowed with OPTIONS")
+		}
+		return Target{Form: TargetAsterisk}, nil
+	case strings.HasPrefix(raw, "/"):
+		t := Target{Form: TargetOrigin}
+		return t, t.setPathAndQuery(raw)
+	}
+	scheme, rest, found := strings.Cut(raw, "://")
+	if !found || !isScheme(scheme) {
+		return Target{}, fmt.Errorf("Malformed request target %q", raw)
+	}
+	host, pathAndQuery := rest, ""
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		host, pathAndQuery = rest[:i], rest[i:]
+	}
+	if host == "" {
+		return Target{}, fmt.Errorf("Missing host in request target %q", raw)
+	}
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	t := Target{Form: TargetAbsolute, Scheme: strings.ToLower(scheme), Host: host}
+	return t, t.setPathAndQuery(pathAndQuery)
+}
+
+// isScheme reports whether s is a URI scheme: a letter followed by
+// letters, digits, "+", "-" or ".".
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !isLetter && (i == 0 || !strings.ContainsRune("0123456789+-.", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Target) setPathAndQuery(s string) error {
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("Invalid escape in request path %q", rawPath)
+	}
+	query, err := parseQuery(rawQuery)
+	if err != nil {
+		return err
+	}
+	t.Path, t.RawPath = path, rawPath
+	t.RawQuery, t.Query = rawQuery, query
+	return nil
+}
+
+// parseQuery decodes an application/x-www-form-urlencoded query, where "+"
+// stands for a space.
+func parseQuery(raw string) (Query, error) {
+	query := Query{}
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid escape in query parameter %q", rawName)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid escape in query parameter %q", rawValue)
+		}
+		query[name] = append(query[name], value)
+	}
+	return query, nil
+}
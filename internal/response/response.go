@@ -3,18 +3,11 @@ package response
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/lucoand/httpfromtcp/internal/headers"
 )
 
-type StatusCode int
-
-const (
-	StatusOK         StatusCode = iota // 200
-	StatusBADREQUEST                   // 400
-	StatusINTERNAL                     // 500
-)
-
 func WriteErrorHelper(err error, n int, line []byte) error {
 	if err != nil {
 		return err
@@ -25,45 +18,53 @@ func WriteErrorHelper(err error, n int, line []byte) error {
 	return nil
 }
 
+// WriteStatusLine writes an HTTP/1.1 status line for statusCode. Codes
+// without a registered reason phrase get an empty one, which RFC 9112
+// allows.
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	switch statusCode {
-	case StatusOK:
-		line := []byte("HTTP/1.1 200 OK\r\n")
-		n, err := w.Write(line)
-		return WriteErrorHelper(err, n, line)
-	case StatusBADREQUEST:
-		line := []byte("HTTP/1.1 400 Bad Request\r\n")
-		n, err := w.Write(line)
-		return WriteErrorHelper(err, n, line)
-	case StatusINTERNAL:
-		line := []byte("HTTP/1.1 500 Internal Server Error\r\n")
-		n, err := w.Write(line)
-		return WriteErrorHelper(err, n, line)
-	default:
-		lineString := "HTTP/1.1 " + fmt.Sprintf("%d \r\n", statusCode)
-		line := []byte(lineString)
-		n, err := w.Write(line)
-		return WriteErrorHelper(err, n, line)
+	return writeStatusLine(w, "HTTP/1.1", statusCode)
+}
+
+func writeStatusLine(w io.Writer, version string, statusCode StatusCode) error {
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("Invalid status code %d", statusCode)
 	}
+	line := fmt.Appendf(nil, "%s %d %s\r\n", version, statusCode, StatusText(statusCode))
+	n, err := w.Write(line)
+	return WriteErrorHelper(err, n, line)
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
-	h := make(map[string]string)
-	h["content-length"] = fmt.Sprintf("%d", contentLen)
-	h["connection"] = "close"
-	h["content-type"] = "text/plain"
+func GetDefaultHeaders(contentLen int) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
+	h.Set("Content-Type", "text/plain")
 	return h
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for k, v := range headers {
-		headerString := k + ": " + v + "\r\n"
-		headerBytes := []byte(headerString)
-		n, err := w.Write(headerBytes)
-		err = WriteErrorHelper(err, n, headerBytes)
-		if err != nil {
-			return err
-		}
+// GetChunkedHeaders returns the default headers for a chunked body, with a
+// Trailer field announcing trailers if any are given.
+func GetChunkedHeaders(trailers ...string) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Type", "text/plain")
+	if len(trailers) > 0 {
+		h.Set("Trailer", strings.Join(trailers, ", "))
+	}
+	return h
+}
+
+// WriteHeaders writes a header section, its fields in order followed by
+// the empty line that ends it.
+func WriteHeaders(w io.Writer, h *headers.Headers) error {
+	return WriteHeadersWithPolicy(w, h, headers.Policy{})
+}
+
+// WriteHeadersWithPolicy is WriteHeaders validating the fields according to
+// p.
+func WriteHeadersWithPolicy(w io.Writer, h *headers.Headers, p headers.Policy) error {
+	err := h.WriteWithPolicy(w, p)
+	if err != nil {
+		return err
 	}
 	headersEndString := "\r\n"
 	headersEndBytes := []byte(headersEndString)
@@ -0,0 +1,45 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStatusLine(t *testing.T) {
+	cases := []struct {
+		code StatusCode
+		line string
+	}{
+		{StatusOK, "HTTP/1.1 200 OK\r\n"},
+		{StatusBadRequest, "HTTP/1.1 400 Bad Request\r\n"},
+		{StatusInternalServerError, "HTTP/1.1 500 Internal Server Error\r\n"},
+		{StatusContinue, "HTTP/1.1 100 Continue\r\n"},
+		{StatusNonAuthoritativeInfo, "HTTP/1.1 203 Non-Authoritative Information\r\n"},
+		{StatusPermanentRedirect, "HTTP/1.1 308 Permanent Redirect\r\n"},
+		{StatusRequestHeaderFieldsTooLarge, "HTTP/1.1 431 Request Header Fields Too Large\r\n"},
+		{StatusNetworkAuthenticationRequired, "HTTP/1.1 511 Network Authentication Required\r\n"},
+		// Test: Unregistered codes keep an empty reason phrase
+		{599, "HTTP/1.1 599 \r\n"},
+		{StatusCode(299), "HTTP/1.1 299 \r\n"},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteStatusLine(buf, c.code))
+		assert.Equal(t, c.line, buf.String())
+	}
+
+	// Test: Codes outside three digits are rejected
+	buf := &bytes.Buffer{}
+	require.Error(t, WriteStatusLine(buf, 0))
+	require.Error(t, WriteStatusLine(buf, 1000))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "Not Found", StatusText(StatusNotFound))
+	assert.Equal(t, "Content Too Large", StatusText(413))
+	assert.Equal(t, "", StatusText(418))
+}
@@ -0,0 +1,385 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+)
+
+// Trailer fields that a Writer computes itself for a chunked body when the
+// response headers announce them in a Trailer field.
+const (
+	TrailerContentSHA256 = "X-Content-SHA256"
+	TrailerContentLength = "X-Content-Length"
+)
+
+type writerState int
+
+const (
+	writerStateStatusLine writerState = iota
+	writerStateHeaders
+	writerStateBody
+	writerStateTrailers
+	writerStateDone
+)
+
+func (s writerState) String() string {
+	switch s {
+	case writerStateStatusLine:
+		return "status line"
+	case writerStateHeaders:
+		return "headers"
+	case writerStateBody:
+		return "body"
+	case writerStateTrailers:
+		return "trailers"
+	case writerStateDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// Writer writes a single response, enforcing that the status line, the
+// headers and then the body are written in that order.
+type Writer struct {
+	w      io.Writer
+	state  writerState
+	status StatusCode
+	// chunked is set when the headers announced a chunked body
+	chunked bool
+	// contentLength is the announced body length, or -1 if there was none
+	contentLength int
+	bodyWritten   int
+	closeConn     bool
+	beforeHeaders []func(h *headers.Headers)
+	// trailers the Writer computes itself because the headers announced
+	// them; sha is nil unless X-Content-SHA256 was announced
+	sha           hash.Hash
+	trailerLength bool
+	// http10 is set for a response to an HTTP/1.0 request
+	http10 bool
+	// rawChunks is set when the handler writes a chunked body to an
+	// HTTP/1.0 client, which gets the data unframed instead
+	rawChunks bool
+	// noBody is set for responses that never carry a body
+	noBody bool
+	// headerPolicy decides which header and trailer values are valid
+	headerPolicy headers.Policy
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:             w,
+		state:         writerStateStatusLine,
+		contentLength: -1,
+	}
+}
+
+func (w *Writer) checkState(want writerState, call string) error {
+	if w.state != want {
+		return fmt.Errorf("%s called while writing %s, expected %s", call, w.state, want)
+	}
+	return nil
+}
+
+// CloseConnection marks the response as the last one on its connection.
+// If the headers have not been written yet, they will carry
+// "Connection: close".
+func (w *Writer) CloseConnection() {
+	w.closeConn = true
+}
+
+// UseHTTP10 makes w answer an HTTP/1.0 request: the status line says
+// HTTP/1.0, the connection is only kept open with an explicit
+// "Connection: keep-alive", and since HTTP/1.0 has no chunked coding a
+// chunked body is sent as plain data ended by closing the connection. It
+// must be called before the status line is written.
+func (w *Writer) UseHTTP10() {
+	w.http10 = true
+}
+
+// UseHeaderPolicy makes w validate header and trailer values according to
+// p, e.g. to refuse obs-text in outgoing fields as well as incoming ones.
+func (w *Writer) UseHeaderPolicy(p headers.Policy) {
+	w.headerPolicy = p
+}
+
+// OmitBody declares that the response has no body whatever its headers
+// say, as for a response to HEAD. A Content-Length is then sent as the
+// length the body would have had, and body writes, chunked or not, succeed
+// without sending anything, so a handler need not treat HEAD specially.
+// 204 and 304 responses are always treated this way. It must be called
+// before the headers are written.
+func (w *Writer) OmitBody() {
+	w.noBody = true
+}
+
+// BeforeHeaders registers f to be called with the headers just before they
+// are written, so the caller can adjust connection management fields.
+// Functions run in the order they were registered.
+func (w *Writer) BeforeHeaders(f func(h *headers.Headers)) {
+	w.beforeHeaders = append(w.beforeHeaders, f)
+}
+
+// Started reports whether any part of the response has been written.
+func (w *Writer) Started() bool {
+	return w.state != writerStateStatusLine
+}
+
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	err := w.checkState(writerStateStatusLine, "WriteStatusLine")
+	if err != nil {
+		return err
+	}
+	version := "HTTP/1.1"
+	if w.http10 {
+		version = "HTTP/1.0"
+	}
+	err = writeStatusLine(w.w, version, statusCode)
+	if err != nil {
+		return err
+	}
+	if statusCode == StatusNoContent || statusCode == StatusNotModified {
+		w.noBody = true
+	}
+	w.status = statusCode
+	w.state = writerStateHeaders
+	return nil
+}
+
+// StatusCode returns the status code written, or 0 if the status line has
+// not been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.status
+}
+
+// BodyBytes returns how many body bytes have been written, not counting
+// chunk framing.
+func (w *Writer) BodyBytes() int {
+	return w.bodyWritten
+}
+
+// WriteHeaders writes the header section. A Transfer-Encoding ending in
+// chunked switches the body to WriteChunkedBody; otherwise Content-Length,
+// if present, bounds what WriteBody accepts. h itself is not modified.
+//
+// Headers that fail validation are refused with nothing written, and
+// WriteHeaders may be called again with corrected ones. The status line is
+// already out by then, so another status can no longer be sent.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	err := w.checkState(writerStateHeaders, "WriteHeaders")
+	if err != nil {
+		return err
+	}
+	// The connection management below works on a copy, and the Writer's
+	// own fields are only updated once the copy is known to be valid, so a
+	// refused attempt leaves no trace.
+	h = h.Clone()
+	for _, f := range w.beforeHeaders {
+		f(h)
+	}
+	rawChunks := w.http10 && !w.noBody && h.HasToken("transfer-encoding", "chunked")
+	if rawChunks {
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+	}
+	// The handler may ask to close the connection itself.
+	closeConn := w.closeConn || rawChunks || h.HasToken("connection", "close")
+	if closeConn {
+		h.Set("Connection", "close")
+	} else if w.http10 {
+		h.Set("Connection", "keep-alive")
+	}
+	err = h.ValidateWithPolicy(w.headerPolicy)
+	if err != nil {
+		return err
+	}
+	chunked := !w.noBody && (rawChunks || h.HasToken("transfer-encoding", "chunked"))
+	contentLength := -1
+	if w.noBody {
+		contentLength = 0
+	} else if v := h.Get("content-length"); v != "" && !chunked {
+		length, err := strconv.Atoi(v)
+		if err != nil || length < 0 {
+			return fmt.Errorf("Invalid content-length header value %q", v)
+		}
+		contentLength = length
+	}
+	w.rawChunks = rawChunks
+	w.closeConn = closeConn
+	w.chunked = chunked
+	w.contentLength = contentLength
+	if chunked && h.HasToken("trailer", TrailerContentSHA256) {
+		w.sha = sha256.New()
+	}
+	w.trailerLength = chunked && h.HasToken("trailer", TrailerContentLength)
+	w.state = writerStateBody
+	return WriteHeadersWithPolicy(w.w, h, w.headerPolicy)
+}
+
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	err := w.checkState(writerStateBody, "WriteBody")
+	if err != nil {
+		return 0, err
+	}
+	if w.noBody {
+		return len(p), nil
+	}
+	if w.chunked {
+		return 0, fmt.Errorf("WriteBody called on a chunked response, use WriteChunkedBody")
+	}
+	if w.contentLength >= 0 && w.bodyWritten+len(p) > w.contentLength {
+		return 0, fmt.Errorf("Body length exceeds content-length header value")
+	}
+	n, err := w.w.Write(p)
+	w.bodyWritten += n
+	return n, err
+}
+
+// Flush sends anything buffered between the Writer and the connection.
+func (w *Writer) Flush() error {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// WriteChunkedBody writes p as a single chunk and flushes it, so streamed
+// output reaches the client as it is produced. Empty writes are skipped, as
+// an empty chunk would end the body.
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	err := w.checkState(writerStateBody, "WriteChunkedBody")
+	if err != nil {
+		return 0, err
+	}
+	if w.noBody {
+		return len(p), nil
+	}
+	if !w.chunked {
+		return 0, fmt.Errorf("WriteChunkedBody called without Transfer-Encoding: chunked")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk := p
+	if !w.rawChunks {
+		chunk = fmt.Appendf(nil, "%x\r\n", len(p))
+		chunk = append(chunk, p...)
+		chunk = append(chunk, headers.CRLF...)
+	}
+	n, err := w.w.Write(chunk)
+	err = WriteErrorHelper(err, n, chunk)
+	if err != nil {
+		return 0, err
+	}
+	if w.sha != nil {
+		w.sha.Write(p)
+	}
+	w.bodyWritten += len(p)
+	return len(p), w.Flush()
+}
+
+// WriteChunkedBodyDone writes the last chunk, ending a chunked body.
+// Trailers may follow with WriteTrailers; otherwise Finish ends the
+// response.
+func (w *Writer) WriteChunkedBodyDone() error {
+	err := w.checkState(writerStateBody, "WriteChunkedBodyDone")
+	if err != nil {
+		return err
+	}
+	if w.noBody {
+		w.state = writerStateTrailers
+		return nil
+	}
+	if !w.chunked {
+		return fmt.Errorf("WriteChunkedBodyDone called without Transfer-Encoding: chunked")
+	}
+	if w.rawChunks {
+		w.state = writerStateTrailers
+		return nil
+	}
+	lastChunk := []byte("0\r\n")
+	n, err := w.w.Write(lastChunk)
+	err = WriteErrorHelper(err, n, lastChunk)
+	if err != nil {
+		return err
+	}
+	w.state = writerStateTrailers
+	return nil
+}
+
+// WriteTrailers writes the trailer section of a chunked body, ending the
+// body first if WriteChunkedBodyDone has not been called. Announced
+// X-Content-SHA256 and X-Content-Length trailers are filled in unless h
+// already sets them.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.state == writerStateBody && (w.chunked || w.noBody) {
+		err := w.WriteChunkedBodyDone()
+		if err != nil {
+			return err
+		}
+	}
+	err := w.checkState(writerStateTrailers, "WriteTrailers")
+	if err != nil {
+		return err
+	}
+	if w.sha != nil && h.Get(TrailerContentSHA256) == "" {
+		h.Set(TrailerContentSHA256, hex.EncodeToString(w.sha.Sum(nil)))
+	}
+	if w.trailerLength && h.Get(TrailerContentLength) == "" {
+		h.Set(TrailerContentLength, strconv.Itoa(w.bodyWritten))
+	}
+	if w.rawChunks || w.noBody {
+		// An HTTP/1.0 client has no way to receive trailers, and a
+		// response without a body has none to send.
+		w.state = writerStateDone
+		return nil
+	}
+	// Checked before the state changes, so that Finish can still end the
+	// body properly after invalid trailers.
+	err = h.ValidateWithPolicy(w.headerPolicy)
+	if err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	err = WriteHeadersWithPolicy(w.w, h, w.headerPolicy)
+	if err != nil {
+		// The body may have been left unterminated.
+		w.CloseConnection()
+	}
+	return err
+}
+
+// Finish completes whatever the handler left unwritten: a 200 status line,
+// empty-body headers, or the end of a chunked body and its trailers. It reports whether the
+// connection can carry another response, which it cannot when the body's
+// end was not delimited by Content-Length or chunked framing.
+func (w *Writer) Finish() (bool, error) {
+	if w.state == writerStateStatusLine {
+		err := w.WriteStatusLine(StatusOK)
+		if err != nil {
+			return false, err
+		}
+	}
+	if w.state == writerStateHeaders {
+		err := w.WriteHeaders(GetDefaultHeaders(0))
+		if err != nil {
+			return false, err
+		}
+	}
+	if (w.state == writerStateBody && w.chunked) || w.state == writerStateTrailers {
+		err := w.WriteTrailers(headers.NewHeaders())
+		if err != nil {
+			return false, err
+		}
+	}
+	framed := (w.chunked && !w.rawChunks) || w.bodyWritten == w.contentLength
+	w.state = writerStateDone
+	return framed && !w.closeConn, nil
+}
@@ -0,0 +1,242 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fields builds headers from alternating names and values.
+func fields(pairs ...string) *headers.Headers {
+	h := headers.NewHeaders()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.Add(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestWriterOrder(t *testing.T) {
+	// Test: Status line, headers and body in order
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("content-length", "5")))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\nhello", buf.String())
+	keepAlive, err := w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+
+	// Test: Out of order calls are rejected
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	require.Error(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.Error(t, w.WriteStatusLine(StatusOK))
+
+	// Test: Body longer than content-length is rejected
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("content-length", "2")))
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+
+	// Test: Body without content-length cannot keep the connection
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	keepAlive, err = w.Finish()
+	require.NoError(t, err)
+	assert.False(t, keepAlive)
+}
+
+func TestWriterChunked(t *testing.T) {
+	// Test: Chunks and trailers
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("transfer-encoding", "chunked")))
+	_, err := w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	_, err = w.WriteChunkedBody([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(fields("x-checksum", "abc")))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n"+
+		"b\r\nhello world\r\n0\r\nx-checksum: abc\r\n\r\n", buf.String())
+	_, err = w.WriteChunkedBody([]byte("late"))
+	require.Error(t, err)
+
+	// Test: Finish terminates an unfinished chunked body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("transfer-encoding", "chunked")))
+	keepAlive, err := w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n0\r\n\r\n", buf.String())
+
+	// Test: Finish fills in an untouched response
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.CloseConnection()
+	keepAlive, err = w.Finish()
+	require.NoError(t, err)
+	assert.False(t, keepAlive)
+	assert.Contains(t, buf.String(), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+}
+
+func TestWriterChunkedTrailers(t *testing.T) {
+	// Test: Announced trailers are computed from the chunks
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("Transfer-Encoding", "chunked", "Trailer", "X-Content-SHA256, X-Content-Length")))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone())
+	_, err = w.WriteChunkedBody([]byte("late"))
+	require.Error(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	out := buf.String()
+	assert.Contains(t, out, "6\r\nhello \r\n5\r\nworld\r\n0\r\n")
+	assert.Contains(t, out, "X-Content-SHA256: b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\r\n")
+	assert.Contains(t, out, "X-Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Finish writes announced trailers after WriteChunkedBodyDone
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetChunkedHeaders(TrailerContentLength)))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone())
+	keepAlive, err := w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+	assert.True(t, strings.HasSuffix(buf.String(), "3\r\nabc\r\n0\r\nX-Content-Length: 3\r\n\r\n"))
+
+	// Test: Trailers given by the handler win over computed ones
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetChunkedHeaders(TrailerContentLength)))
+	require.NoError(t, w.WriteTrailers(fields("x-content-length", "42")))
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nx-content-length: 42\r\n\r\n"))
+
+	// Test: Invalid trailers are refused and Finish still ends the body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetChunkedHeaders()))
+	require.Error(t, w.WriteTrailers(fields("X-Bad", "a\r\nb")))
+	keepAlive, err = w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"))
+
+	// Test: WriteChunkedBodyDone needs a chunked body
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.Error(t, w.WriteChunkedBodyDone())
+}
+
+func TestWriterBeforeHeaders(t *testing.T) {
+	// Test: Every registered hook runs, in the order it was registered
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	var order []string
+	w.BeforeHeaders(func(h *headers.Headers) {
+		order = append(order, "first")
+		h.Add("X-Hook", "first")
+	})
+	w.BeforeHeaders(func(h *headers.Headers) {
+		order = append(order, "second")
+		h.Add("X-Hook", "second")
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("Content-Length", "0")))
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Contains(t, buf.String(), "X-Hook: first\r\nX-Hook: second\r\n")
+}
+
+func TestWriterRejectsInvalidHeaders(t *testing.T) {
+	// Test: An injected CRLF is refused and corrected headers can follow
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusFound))
+	require.Error(t, w.WriteHeaders(fields("Location", "/x\r\nSet-Cookie: evil=1")))
+	assert.Equal(t, "HTTP/1.1 302 Found\r\n", buf.String())
+	require.NoError(t, w.WriteHeaders(fields("Location", "/x")))
+	assert.NotContains(t, buf.String(), "evil")
+
+	// Test: A rejected chunked attempt for HTTP/1.0 leaves no trace on a
+	// Content-Length retry
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHTTP10()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	bad := GetChunkedHeaders()
+	bad.Set("X-Echo", "a\x00b")
+	require.Error(t, w.WriteHeaders(bad))
+	assert.Equal(t, "chunked", bad.Get("Transfer-Encoding"))
+	assert.False(t, bad.Has("Connection"))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	keepAlive, err := w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nok"))
+}
+
+func TestWriterBodyless(t *testing.T) {
+	// Test: A 304 keeps its Content-Length without a body following
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(42)))
+	keepAlive, err := w.Finish()
+	require.NoError(t, err)
+	assert.True(t, keepAlive)
+	assert.Contains(t, buf.String(), "Content-Length: 42\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+
+	// Test: OmitBody discards body bytes and drops chunked framing
+	for _, h := range []*headers.Headers{GetDefaultHeaders(42), GetChunkedHeaders(TrailerContentLength)} {
+		buf = &bytes.Buffer{}
+		w = NewWriter(buf)
+		w.OmitBody()
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(h))
+		n, err := w.WriteBody([]byte("x"))
+		if h.Has("transfer-encoding") {
+			n, err = w.WriteChunkedBody([]byte("x"))
+			require.NoError(t, err)
+			require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+		}
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		keepAlive, err = w.Finish()
+		require.NoError(t, err)
+		assert.True(t, keepAlive)
+		assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+		assert.NotContains(t, buf.String(), "x\r\n")
+	}
+}
@@ -0,0 +1,282 @@
+// Package router dispatches requests to handlers by method and path
+// pattern.
+//
+// A pattern is an optional method followed by a path, e.g. "GET /users/{id}"
+// or "/health". Path segments are matched literally, except that "{name}"
+// matches any single segment and a final "{name...}" matches the rest of the
+// path, including further slashes. Paths are matched on the parsed request
+// target, so absolute-form targets route like origin-form ones, and matched
+// segments are stored percent-decoded in request.Request.Params.
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/lucoand/httpfromtcp/internal/server"
+)
+
+type segmentKind int
+
+// Kinds are ordered from most to least specific, which is the order routes
+// are preferred in when several match.
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// text is the literal to match, or the parameter name
+	text string
+}
+
+type route struct {
+	// method is empty for routes that match any method
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+type mount struct {
+	prefix  string
+	handler server.Handler
+}
+
+// Router is a server.Handler that dispatches to the handler registered for
+// the request's method and path. Requests matching no path are answered
+// with 404, and requests whose path matches but whose method does not with
+// 405 and an Allow header.
+type Router struct {
+	routes []*route
+	mounts []mount
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers h for pattern. It panics if the pattern is malformed or
+// already registered, as both are programming errors.
+func (rt *Router) Handle(pattern string, h server.Handler) {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	for _, existing := range rt.routes {
+		if existing.method == r.method && sameShape(existing.segments, r.segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+	r.handler = h
+	rt.routes = append(rt.routes, r)
+}
+
+// Mount passes every request whose path is prefix, or lies under it, to h
+// with the prefix stripped from the request target. Routes registered with
+// Handle take precedence over mounts, and longer prefixes over shorter ones,
+// so a mount at "/" catches whatever nothing else matched.
+func (rt *Router) Mount(prefix string, h server.Handler) {
+	if !strings.HasPrefix(prefix, "/") {
+		panic(fmt.Sprintf("router: mount prefix %q must start with /", prefix))
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	rt.mounts = append(rt.mounts, mount{prefix: prefix, handler: h})
+	sort.SliceStable(rt.mounts, func(i, j int) bool {
+		return len(rt.mounts[i].prefix) > len(rt.mounts[j].prefix)
+	})
+}
+
+func parsePattern(pattern string) (*route, error) {
+	r := &route{pattern: pattern}
+	path := pattern
+	if method, rest, found := strings.Cut(pattern, " "); found {
+		r.method = method
+		path = strings.TrimLeft(rest, " ")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("router: pattern %q must have a path starting with /", pattern)
+	}
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			r.segments = append(r.segments, segment{kind: segmentLiteral, text: part})
+			continue
+		}
+		name := part[1 : len(part)-1]
+		kind := segmentParam
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: wildcard in pattern %q must be the last segment", pattern)
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = segmentWildcard
+		}
+		if name == "" {
+			return nil, fmt.Errorf("router: pattern %q has an unnamed parameter", pattern)
+		}
+		r.segments = append(r.segments, segment{kind: kind, text: name})
+	}
+	return r, nil
+}
+
+// sameShape reports whether a and b match exactly the same paths.
+func sameShape(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind || (a[i].kind == segmentLiteral && a[i].text != b[i].text) {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the parameters r extracts from the raw path segments, or
+// false if r does not match them. Segments are split before decoding, so
+// an encoded slash stays inside its segment.
+func (r *route) match(parts []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			params[seg.text] = unescape(strings.Join(parts[i:], "/"))
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if unescape(parts[i]) != seg.text {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.text] = unescape(parts[i])
+		}
+	}
+	return params, len(parts) == len(r.segments)
+}
+
+// moreSpecific reports whether a should be preferred over b: the first
+// segment where they differ decides, literals beating parameters beating
+// wildcards, and a method-specific route beats one for any method.
+func moreSpecific(a, b *route) bool {
+	for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) > len(b.segments)
+	}
+	return a.method != "" && b.method == ""
+}
+
+// unescape percent-decodes a path segment. The request parser has already
+// rejected invalid escapes, so s is returned as is only for requests built
+// by hand.
+func unescape(s string) string {
+	decoded, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// stripPrefix removes prefix from path, keeping the result rooted at "/".
+// A path without the prefix, such as the empty path of a request built by
+// hand, is returned unchanged.
+func stripPrefix(path, prefix string) string {
+	rest, found := strings.CutPrefix(path, prefix)
+	if !found {
+		return path
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// Serve is the server.Handler that dispatches req.
+func (rt *Router) Serve(w *response.Writer, req *request.Request) *server.HandlerError {
+	path := req.Target.RawPath
+	if path == "" {
+		// CONNECT and "OPTIONS *" name no path to route on.
+		return notFound()
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	var best *route
+	var bestParams map[string]string
+	allowed := make(map[string]bool)
+	for _, r := range rt.routes {
+		params, ok := r.match(parts)
+		if !ok {
+			continue
+		}
+		if r.method != "" && r.method != req.RequestLine.Method {
+			allowed[r.method] = true
+			continue
+		}
+		if best == nil || moreSpecific(r, best) {
+			best, bestParams = r, params
+		}
+	}
+	if best != nil {
+		if req.Params == nil {
+			req.Params = make(map[string]string)
+		}
+		for k, v := range bestParams {
+			req.Params[k] = v
+		}
+		return best.handler(w, req)
+	}
+	if len(allowed) > 0 {
+		return methodNotAllowed(allowed)
+	}
+
+	for _, m := range rt.mounts {
+		if path != m.prefix && !strings.HasPrefix(path, m.prefix+"/") {
+			continue
+		}
+		sub := *req
+		sub.RequestLine.RequestTarget = stripPrefix(req.RequestLine.RequestTarget, m.prefix)
+		sub.Target.RawPath = stripPrefix(req.Target.RawPath, m.prefix)
+		sub.Target.Path = stripPrefix(req.Target.Path, m.prefix)
+		return m.handler(w, &sub)
+	}
+	return notFound()
+}
+
+func notFound() *server.HandlerError {
+	return &server.HandlerError{
+		StatusCode: response.StatusNotFound,
+		Message:    "Not found\n",
+	}
+}
+
+func methodNotAllowed(allowed map[string]bool) *server.HandlerError {
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(methods, ", "))
+	return &server.HandlerError{
+		StatusCode: response.StatusMethodNotAllowed,
+		Message:    "Method not allowed\n",
+		Headers:    h,
+	}
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/lucoand/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// named returns a handler that records its name and the request it got.
+func named(name string, got *string, gotReq **request.Request) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		*got = name
+		*gotReq = req
+		return nil
+	}
+}
+
+// newRequest parses a request for target, so its Target is filled in as
+// it would be by the server.
+func newRequest(method, target string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func TestRouterMatching(t *testing.T) {
+	var got string
+	var gotReq *request.Request
+	rt := New()
+	rt.Handle("GET /users", named("list", &got, &gotReq))
+	rt.Handle("GET /users/{id}", named("show", &got, &gotReq))
+	rt.Handle("GET /users/me", named("me", &got, &gotReq))
+	rt.Handle("DELETE /users/{id}", named("delete", &got, &gotReq))
+	rt.Handle("GET /users/{id}/posts/{post}", named("post", &got, &gotReq))
+	rt.Handle("/static/{path...}", named("static", &got, &gotReq))
+
+	tests := []struct {
+		method, target, want string
+		params               map[string]string
+	}{
+		{"GET", "/users", "list", map[string]string{}},
+		{"GET", "/users/42", "show", map[string]string{"id": "42"}},
+		{"GET", "/users/42?full=1", "show", map[string]string{"id": "42"}},
+		{"GET", "/users/me", "me", map[string]string{}},
+		{"DELETE", "/users/42", "delete", map[string]string{"id": "42"}},
+		{"GET", "/users/7/posts/9", "post", map[string]string{"id": "7", "post": "9"}},
+		{"POST", "/static/css/site.css", "static", map[string]string{"path": "css/site.css"}},
+		{"GET", "http://example.com/users/42?full=1", "show", map[string]string{"id": "42"}},
+		{"GET", "/users/j%C3%B6rg", "show", map[string]string{"id": "jörg"}},
+		{"GET", "/users/a%2Fb", "show", map[string]string{"id": "a/b"}},
+		{"GET", "/static/a%20b/c.txt", "static", map[string]string{"path": "a b/c.txt"}},
+	}
+	for _, tc := range tests {
+		// Test: Each request reaches the most specific matching route
+		got = ""
+		herr := rt.Serve(nil, newRequest(tc.method, tc.target))
+		require.Nil(t, herr, "%s %s", tc.method, tc.target)
+		assert.Equal(t, tc.want, got, "%s %s", tc.method, tc.target)
+		assert.Equal(t, tc.params, gotReq.Params, "%s %s", tc.method, tc.target)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	var got string
+	var gotReq *request.Request
+	rt := New()
+	rt.Handle("GET /users/{id}", named("show", &got, &gotReq))
+	rt.Handle("PUT /users/{id}", named("update", &got, &gotReq))
+
+	// Test: An unknown path is answered with 404
+	herr := rt.Serve(nil, newRequest("GET", "/nope"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: A known path with the wrong method is answered with 405 and Allow
+	herr = rt.Serve(nil, newRequest("POST", "/users/1"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusMethodNotAllowed, herr.StatusCode)
+	assert.Equal(t, "GET, PUT", herr.Headers.Get("allow"))
+
+	// Test: A parameter does not match an empty segment
+	herr = rt.Serve(nil, newRequest("GET", "/users/"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: A target without a path matches nothing
+	herr = rt.Serve(nil, newRequest("OPTIONS", "*"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Malformed and duplicate patterns panic
+	assert.Panics(t, func() { rt.Handle("GET users", named("x", &got, &gotReq)) })
+	assert.Panics(t, func() { rt.Handle("GET /a/{rest...}/b", named("x", &got, &gotReq)) })
+	assert.Panics(t, func() { rt.Handle("GET /users/{other}", named("x", &got, &gotReq)) })
+}
+
+func TestRouterMount(t *testing.T) {
+	var got string
+	var gotReq *request.Request
+	api := New()
+	api.Handle("GET /items/{id}", named("item", &got, &gotReq))
+	rt := New()
+	rt.Mount("/api/", api.Serve)
+	rt.Mount("/api/v2", named("v2", &got, &gotReq))
+	rt.Handle("GET /api/health", named("health", &got, &gotReq))
+
+	// Test: A mounted router sees the target with the prefix stripped
+	herr := rt.Serve(nil, newRequest("GET", "/api/items/5?x=1"))
+	require.Nil(t, herr)
+	assert.Equal(t, "item", got)
+	assert.Equal(t, "5", gotReq.Param("id"))
+	assert.Equal(t, "/items/5?x=1", gotReq.RequestLine.RequestTarget)
+	assert.Equal(t, "/items/5", gotReq.Target.Path)
+	assert.Equal(t, "1", gotReq.Target.Query.Get("x"))
+
+	// Test: The longest prefix wins and the bare prefix maps to /
+	herr = rt.Serve(nil, newRequest("GET", "/api/v2"))
+	require.Nil(t, herr)
+	assert.Equal(t, "v2", got)
+	assert.Equal(t, "/", gotReq.RequestLine.RequestTarget)
+	assert.Equal(t, "/", gotReq.Target.Path)
+
+	// Test: Routes take precedence over mounts
+	herr = rt.Serve(nil, newRequest("GET", "/api/health"))
+	require.Nil(t, herr)
+	assert.Equal(t, "health", got)
+
+	// Test: A prefix only matches whole segments
+	herr = rt.Serve(nil, newRequest("GET", "/apiary"))
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: A root mount catches everything else, target unchanged
+	rt.Mount("/", named("root", &got, &gotReq))
+	herr = rt.Serve(nil, newRequest("GET", "/apiary?x=1"))
+	require.Nil(t, herr)
+	assert.Equal(t, "root", got)
+	assert.Equal(t, "/apiary?x=1", gotReq.RequestLine.RequestTarget)
+	assert.Equal(t, "/apiary", gotReq.Target.Path)
+	herr = rt.Serve(nil, newRequest("GET", "/api/v2/x"))
+	require.Nil(t, herr)
+	assert.Equal(t, "v2", got)
+
+	// Test: A prefix not starting with / panics
+	assert.Panics(t, func() { rt.Mount("api", named("x", &got, &gotReq)) })
+}
+
+func TestRouterWithServer(t *testing.T) {
+	// Test: A 405 from the router reaches the client with its Allow header
+	rt := New()
+	rt.Handle("GET /", func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return nil
+	})
+	s, err := server.Serve(0, rt.Serve)
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET", resp.Header.Get("Allow"))
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+)
+
+// AccessLogFormat selects how a Server writes its access log.
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon is the Common Log Format, followed by the time taken
+	// to serve the request in microseconds:
+	//
+	//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 2326 1042
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined adds the Referer and User-Agent fields to
+	// AccessLogCommon, before the duration.
+	AccessLogCombined
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessEntry is what the access log records about one request.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Proto      string    `json:"proto,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	// DurationMicros is the time from the start of the request to the end
+	// of the response.
+	DurationMicros int64  `json:"duration_us"`
+	Referer        string `json:"referer,omitempty"`
+	UserAgent      string `json:"user_agent,omitempty"`
+}
+
+func newAccessEntry(start time.Time, remoteAddr string, req *request.Request, rw *response.Writer) accessEntry {
+	e := accessEntry{
+		Time:           start,
+		RemoteAddr:     remoteAddr,
+		Status:         int(rw.StatusCode()),
+		Bytes:          rw.BodyBytes(),
+		DurationMicros: time.Since(start).Microseconds(),
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		e.RemoteAddr = host
+	}
+	// req is nil for requests that could not be parsed.
+	if req != nil {
+		e.Method = req.RequestLine.Method
+		e.Target = req.RequestLine.RequestTarget
+		e.Proto = "HTTP/" + req.RequestLine.HttpVersion
+		e.Referer = req.Headers.Get("referer")
+		e.UserAgent = req.Headers.Get("user-agent")
+	}
+	return e
+}
+
+// orDash returns "-", which the Common Log Format uses for missing values,
+// if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (e accessEntry) format(f AccessLogFormat) []byte {
+	if f == AccessLogJSON {
+		line, _ := json.Marshal(e)
+		return append(line, '\n')
+	}
+	requestLine := "-"
+	if e.Method != "" {
+		requestLine = e.Method + " " + e.Target + " " + e.Proto
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+	line := fmt.Appendf(nil, "%s - - [%s] %s %d %s",
+		orDash(e.RemoteAddr), e.Time.Format(clfTimeFormat), strconv.Quote(requestLine), e.Status, bytes)
+	if f == AccessLogCombined {
+		line = fmt.Appendf(line, " %s %s", strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+	}
+	return fmt.Appendf(line, " %d\n", e.DurationMicros)
+}
+
+// logAccess writes the access log entry for a request, if the Server has
+// an access log.
+func (s *Server) logAccess(start time.Time, remoteAddr string, req *request.Request, rw *response.Writer) {
+	if s.AccessLog == nil || rw.StatusCode() == 0 {
+		return
+	}
+	entry := newAccessEntry(start, remoteAddr, req, rw)
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	_, err := s.AccessLog.Write(entry.format(s.AccessLogFormat))
+	if err != nil {
+		s.logger().Error("Writing access log", "error", err)
+	}
+}
+
+// logger returns the Server's Logger, or slog's default one.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/request"
+)
+
+// aLongTimeAgo is a read deadline in the past, used to unblock a pending
+// Read on a connection immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader sits between a connection and its request.Reader. While a
+// handler runs it keeps a one-byte read pending on the connection so that a
+// client hanging up can cancel the request's context.
+type connReader struct {
+	conn net.Conn
+	// byteBuf holds a byte picked up by the background read, which belongs
+	// to the next (pipelined) request.
+	byteBuf [1]byte
+	hasByte bool
+	err     error
+	bgDone  chan struct{}
+	aborted atomic.Bool
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		return 1, nil
+	}
+	return cr.conn.Read(p)
+}
+
+// startBackgroundRead watches the connection while a handler runs and calls
+// cancel if the client disconnects. abortPendingRead must be called before
+// the connection is read from again.
+func (cr *connReader) startBackgroundRead(cancel context.CancelFunc) {
+	if cr.hasByte || cr.err != nil {
+		return
+	}
+	cr.bgDone = make(chan struct{})
+	go func() {
+		defer close(cr.bgDone)
+		n, err := cr.conn.Read(cr.byteBuf[:])
+		if n == 1 {
+			cr.hasByte = true
+		}
+		if err == nil {
+			return
+		}
+		if cr.aborted.Load() && errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		cr.err = err
+		cancel()
+	}()
+}
+
+// abortPendingRead stops a read started by startBackgroundRead and waits
+// for it to finish.
+func (cr *connReader) abortPendingRead() {
+	if cr.bgDone == nil {
+		return
+	}
+	cr.aborted.Store(true)
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	<-cr.bgDone
+	cr.conn.SetReadDeadline(time.Time{})
+	cr.aborted.Store(false)
+	cr.bgDone = nil
+}
+
+// watchedBody passes a request body through to the handler and calls
+// onConsumed once all of it has been read from the connection.
+type watchedBody struct {
+	io.ReadCloser
+	// req is the request the body belongs to.
+	req        *request.Request
+	onConsumed func()
+	// err is the first read error other than io.EOF.
+	err error
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && b.err == nil {
+		b.err = err
+	}
+	if b.onConsumed != nil && b.req.BodyConsumed() {
+		b.onConsumed()
+		b.onConsumed = nil
+	}
+	return n, err
+}
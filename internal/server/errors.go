@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/response"
+)
+
+// HandlerError is returned by a handler that wants the server to answer
+// with an error response instead of writing one itself.
+type HandlerError struct {
+	StatusCode response.StatusCode
+	// Message is rendered as the body of the error response.
+	Message string
+	// Headers are added to the error response, replacing any default
+	// header of the same name.
+	Headers *headers.Headers
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, response.StatusText(e.StatusCode), e.Message)
+}
+
+// ErrorRenderer turns a HandlerError into the content type and body of
+// the error response.
+type ErrorRenderer func(herr *HandlerError) (contentType string, body []byte)
+
+// TextErrorRenderer renders the message as plain text. It is used when a
+// Server has no ErrorRenderer.
+func TextErrorRenderer(herr *HandlerError) (string, []byte) {
+	return "text/plain", []byte(herr.Message)
+}
+
+// HTMLErrorRenderer renders a minimal HTML page with the status and the
+// escaped message.
+func HTMLErrorRenderer(herr *HandlerError) (string, []byte) {
+	title := fmt.Sprintf("%d %s", herr.StatusCode, response.StatusText(herr.StatusCode))
+	body := "<html>\n" +
+		"  <head>\n" +
+		"    <title>" + html.EscapeString(title) + "</title>\n" +
+		"  </head>\n" +
+		"  <body>\n" +
+		"    <h1>" + html.EscapeString(title) + "</h1>\n" +
+		"    <p>" + html.EscapeString(strings.TrimSpace(herr.Message)) + "</p>\n" +
+		"  </body>\n" +
+		"</html>\n"
+	return "text/html", []byte(body)
+}
+
+// JSONErrorRenderer renders {"status": ..., "error": ..., "message": ...}.
+func JSONErrorRenderer(herr *HandlerError) (string, []byte) {
+	body, err := json.Marshal(struct {
+		Status  int    `json:"status"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{
+		Status:  int(herr.StatusCode),
+		Error:   response.StatusText(herr.StatusCode),
+		Message: strings.TrimSpace(herr.Message),
+	})
+	if err != nil {
+		return TextErrorRenderer(herr)
+	}
+	return "application/json", append(body, '\n')
+}
+
+// writeHandlerError writes herr as a complete response through w using the
+// server's ErrorRenderer. A HandlerError without a valid status code is
+// treated as a 500.
+func (s *Server) writeHandlerError(w *response.Writer, herr *HandlerError) error {
+	if herr.StatusCode < 100 || herr.StatusCode > 999 {
+		fixed := *herr
+		fixed.StatusCode = response.StatusInternalServerError
+		herr = &fixed
+	}
+	render := s.ErrorRenderer
+	if render == nil {
+		render = TextErrorRenderer
+	}
+	contentType, body := render(herr)
+	err := w.WriteStatusLine(herr.StatusCode)
+	if err != nil {
+		return err
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+	for name := range herr.Headers.All() {
+		h.Del(name)
+	}
+	for name, value := range herr.Headers.All() {
+		h.Add(name, value)
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
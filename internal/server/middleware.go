@@ -0,0 +1,15 @@
+package server
+
+// Middleware wraps a Handler with behavior that runs around it, such as
+// logging or authentication. It may answer the request itself instead of
+// calling the handler it wraps.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in middleware. The first middleware is the outermost, so
+// it sees the request first and the response last.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
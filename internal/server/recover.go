@@ -0,0 +1,63 @@
+package server
+
+import (
+	"runtime/debug"
+
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+)
+
+// PanicHook is called with the recovered value and stack trace of a panic
+// raised while serving a request. req is nil if the panic happened outside
+// the handler.
+type PanicHook func(req *request.Request, recovered any, stack []byte)
+
+// callHandler runs the handler, converting a panic into a report and a
+// true panicked result so the caller can answer or abort.
+func (s *Server) callHandler(rw *response.Writer, req *request.Request) (herr *HandlerError, panicked bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		s.reportPanic(req, recovered, debug.Stack())
+		herr, panicked = nil, true
+	}()
+	return s.Handler(rw, req), false
+}
+
+// recoverConn stops a panic in a connection goroutine from taking down the
+// process. It must be deferred directly by the goroutine's function.
+func (s *Server) recoverConn() {
+	recovered := recover()
+	if recovered != nil {
+		s.reportPanic(nil, recovered, debug.Stack())
+	}
+}
+
+func (s *Server) reportPanic(req *request.Request, recovered any, stack []byte) {
+	if req != nil {
+		s.logger().Error("Panic serving request", "remote_addr", req.RemoteAddr,
+			"method", req.RequestLine.Method, "target", req.RequestLine.RequestTarget,
+			"panic", recovered, "stack", string(stack))
+	} else {
+		s.logger().Error("Panic in connection handler", "panic", recovered, "stack", string(stack))
+	}
+	if s.OnPanic != nil {
+		s.OnPanic(req, recovered, stack)
+	}
+}
+
+// panicResponse answers a request whose handler panicked: with a 500 if
+// nothing has been written yet, otherwise by dropping the connection. The
+// connection is never reused, as the handler's state is unknown.
+func (s *Server) panicResponse(rw *response.Writer) {
+	if rw.Started() {
+		return
+	}
+	rw.CloseConnection()
+	s.writeHandlerError(rw, &HandlerError{
+		StatusCode: response.StatusInternalServerError,
+		Message:    "Internal Server Error\n",
+	})
+}
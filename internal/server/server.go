@@ -1,103 +1,426 @@
 package server
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/lucoand/httpfromtcp/internal/headers"
 	"github.com/lucoand/httpfromtcp/internal/request"
 	"github.com/lucoand/httpfromtcp/internal/response"
 )
 
+// DefaultIdleTimeout is how long Serve keeps an idle keep-alive connection
+// open waiting for the next request.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// DefaultLimits are the request size limits used by Serve.
+var DefaultLimits = request.Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      1 << 20,
+	MaxHeaderCount:      100,
+	MaxBodyBytes:        10 << 20,
+}
+
+// maxDiscardBytes is how much of a body the handler left unread the server
+// will read and throw away to keep the connection open. With more than
+// that left, or an unknown amount, the connection is closed instead, so
+// that refusing a large upload does not mean receiving it anyway.
+const maxDiscardBytes = 256 << 10
+
+// DefaultReadHeaderTimeout is how long Serve gives a client to send a
+// request line and headers once the request has started.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
 type Server struct {
+	// Addr is the "host:port" Start listens on, e.g. "[::]:8080" for every
+	// interface. Empty means an ephemeral port on 127.0.0.1.
+	Addr     string
 	IsClosed *atomic.Bool
 	Listener net.Listener
 	Handler  Handler
-}
 
-type Handler func(w io.Writer, req *request.Request) *HandlerError
+	// Timeouts are applied as deadlines on each connection. Zero means no
+	// timeout.
+	//
+	// ReadHeaderTimeout bounds reading the request line and headers, and
+	// ReadTimeout the whole request including its body, both measured from
+	// the first byte of the request. A request that times out is answered
+	// with 408 Request Timeout.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout bounds the time from the end of the request to the end
+	// of the response. It is also the deadline of the request's context.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next request on a keep-alive
+	// connection.
+	IdleTimeout time.Duration
+
+	// ErrorRenderer renders the body of error responses, both for a
+	// HandlerError and for requests the server rejects itself. Nil means
+	// TextErrorRenderer.
+	ErrorRenderer ErrorRenderer
+
+	// Limits caps the size of each request. Requests over a limit are
+	// answered with 414, 431 or 413 and the connection is closed. A chunked
+	// body that outgrows MaxBodyBytes can only be detected while the
+	// handler reads it, so it surfaces as a LimitError from BodyReader.
+	Limits request.Limits
+	// HeaderPolicy selects how obsolete syntax in request header values is
+	// treated, and whether responses may carry obs-text. The zero value
+	// accepts obs-text and rejects obs-fold.
+	HeaderPolicy headers.Policy
+
+	// OnPanic, if set, is called after a panic while serving a request has
+	// been recovered and logged, e.g. to report it to an error tracker.
+	OnPanic PanicHook
 
-type HandlerError struct {
-	StatusCode string
-	Message    string
+	// Logger receives the server's diagnostic messages. Nil means
+	// slog.Default().
+	Logger *slog.Logger
+	// AccessLog, if set, receives one line per response in
+	// AccessLogFormat.
+	AccessLog       io.Writer
+	AccessLogFormat AccessLogFormat
+
+	accessMu sync.Mutex
+	mu       sync.Mutex
+	conns    map[net.Conn]connState
+	// baseCtx is the parent of every request context and is cancelled as
+	// soon as the server starts shutting down.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
+// Handler answers a request by writing its response through w. Anything
+// left unwritten when it returns is completed by the server: a bare
+// 200 OK if nothing was written, or the end of a chunked body.
+//
+// The request body is not read in advance: the handler streams it from
+// req.BodyReader, or buffers it with req.ReadBody, under the server's
+// ReadTimeout. A little of the body left unread is discarded before the
+// next request on the connection; if more is left, the response closes the
+// connection instead.
+type Handler func(w *response.Writer, req *request.Request) *HandlerError
+
+// maxAcceptDelay caps the back-off between retries of a failing Accept.
+const maxAcceptDelay = time.Second
+
 func (s *Server) listen() {
+	var delay time.Duration
 	for !s.IsClosed.Load() {
 		conn, err := s.Listener.Accept()
-		if err != nil && !s.IsClosed.Load() {
-			continue
+		if s.IsClosed.Load() {
+			if conn != nil {
+				conn.Close()
+			}
+			return
 		}
-		if !s.IsClosed.Load() {
-			fmt.Println("Handling request")
-			go s.handle(conn)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || !isTemporary(err) {
+				s.logger().Error("Accept failed, no longer accepting connections", "error", err)
+				return
+			}
+			// Errors like running out of file descriptors may clear up,
+			// so retry, but without spinning on them.
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			s.logger().Warn("Accept failed, retrying", "error", err, "delay", delay)
+			time.Sleep(delay)
+			continue
 		}
+		delay = 0
+		s.logger().Debug("Accepted connection", "remote_addr", conn.RemoteAddr().String())
+		s.setConnState(conn, connStateIdle)
+		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
-	fmt.Println("Parsing request")
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		return
+	defer s.recoverConn()
+	connCtx, cancelConn := context.WithCancel(s.baseCtx)
+	defer cancelConn()
+	cr := &connReader{conn: conn}
+	reader := request.NewReader(cr)
+	reader.Limits = s.Limits
+	reader.HeaderPolicy = s.HeaderPolicy
+	// Responses are written strictly in request order; buffering lets each
+	// one leave in a single write even when requests were pipelined.
+	bw := bufio.NewWriter(conn)
+	for !s.IsClosed.Load() {
+		s.setConnState(conn, connStateIdle)
+		conn.SetWriteDeadline(time.Time{})
+		conn.SetReadDeadline(deadline(time.Now(), s.IdleTimeout))
+		err := reader.Wait()
+		if err != nil {
+			return
+		}
+		s.setConnState(conn, connStateActive)
+		keepAlive := s.serveRequest(connCtx, conn, bw, cr, reader)
+		err = bw.Flush()
+		if err != nil || !keepAlive {
+			return
+		}
 	}
-	fmt.Println("Request parsed")
+}
 
-	buf := &bytes.Buffer{}
-	fmt.Println("Buffer created")
-	handlerError := s.Handler(buf, req)
-	fmt.Println("Handler called")
-	if handlerError != nil {
-		writeHandlerError(conn, handlerError)
-		return
+// isTemporary reports whether err says it may go away on retrying, as
+// syscall errors such as EMFILE and ECONNABORTED do.
+func isTemporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// deadline returns the instant timeout after start, or the zero time (no
+// deadline) if timeout is not positive.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// readRequest reads the next request line and headers from reader,
+// applying the header timeout from the moment it is called. The read
+// timeout is left in place for the handler to read the body under.
+func (s *Server) readRequest(conn net.Conn, reader *request.Reader) (*request.Request, error) {
+	start := time.Now()
+	readDeadline := deadline(start, s.ReadTimeout)
+	headerDeadline := deadline(start, s.ReadHeaderTimeout)
+	if headerDeadline.IsZero() || (!readDeadline.IsZero() && readDeadline.Before(headerDeadline)) {
+		headerDeadline = readDeadline
 	}
-	h := response.GetDefaultHeaders(buf.Len())
-	err = response.WriteStatusLine(conn, response.StatusOK)
+	conn.SetReadDeadline(headerDeadline)
+	req, err := reader.StreamRequest()
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = response.WriteHeaders(conn, h)
+	conn.SetReadDeadline(readDeadline)
+	return req, nil
+}
+
+// serveRequest reads and answers a single request, reporting whether the
+// connection may be reused for another one.
+func (s *Server) serveRequest(connCtx context.Context, conn net.Conn, w io.Writer, cr *connReader, reader *request.Reader) bool {
+	start := time.Now()
+	remoteAddr := conn.RemoteAddr().String()
+	req, err := s.readRequest(conn, reader)
 	if err != nil {
-		return
+		s.logger().Debug("Reading request failed", "remote_addr", remoteAddr, "error", err)
+		herr := requestErrorResponse(err)
+		if herr != nil {
+			rw := response.NewWriter(w)
+			rw.UseHeaderPolicy(s.HeaderPolicy)
+			rw.CloseConnection()
+			s.writeHandlerError(rw, herr)
+			s.logAccess(start, remoteAddr, nil, rw)
+		}
+		return false
+	}
+	s.logger().Debug("Request parsed", "remote_addr", remoteAddr,
+		"method", req.RequestLine.Method, "target", req.RequestLine.RequestTarget)
+	conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.WriteTimeout > 0 {
+		ctx, cancel = context.WithTimeout(connCtx, s.WriteTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(connCtx)
+	}
+	defer cancel()
+	// The connection can only be watched for a disconnect once the handler
+	// has read the body, as both read from it.
+	watch := func() {
+		conn.SetReadDeadline(time.Time{})
+		cr.startBackgroundRead(cancel)
+	}
+	defer cr.abortPendingRead()
+	req = req.WithContext(ctx)
+	req.RemoteAddr = remoteAddr
+	body := &watchedBody{ReadCloser: req.BodyReader, req: req, onConsumed: watch}
+	if req.BodyConsumed() {
+		watch()
+	} else {
+		req.BodyReader = body
+	}
+	rw := response.NewWriter(w)
+	rw.UseHeaderPolicy(s.HeaderPolicy)
+	if req.RequestLine.Method == "HEAD" {
+		// Whatever the handler or an error response writes as the body
+		// must not reach the client, which reads none.
+		rw.OmitBody()
 	}
+	defer func() {
+		s.logAccess(start, remoteAddr, req, rw)
+	}()
+	if req.Headers.HasToken("connection", "close") {
+		rw.CloseConnection()
+	}
+	if req.RequestLine.HttpVersion == "1.0" {
+		// HTTP/1.0 connections close after each response unless the
+		// client asks otherwise.
+		rw.UseHTTP10()
+		if !req.Headers.HasToken("connection", "keep-alive") {
+			rw.CloseConnection()
+		}
+	} else if !req.Headers.Has("host") {
+		// RFC 9112 section 3.2: an HTTP/1.1 request must name its host.
+		rw.CloseConnection()
+		s.writeHandlerError(rw, &HandlerError{
+			StatusCode: response.StatusBadRequest,
+			Message:    "Bad Request: Missing Host header\n",
+		})
+		return false
+	}
+	// A shutdown that began while the handler ran still lets this response
+	// out, but it must be the last one on the connection.
+	rw.BeforeHeaders(func(h *headers.Headers) {
+		if s.IsClosed.Load() {
+			rw.CloseConnection()
+		}
+		closeIfBodyLeft(rw, req)
+	})
 
-	io.Copy(conn, buf)
+	handlerError, panicked := s.callHandler(rw, req)
+	if panicked {
+		s.panicResponse(rw)
+		return false
+	}
+	if body.err != nil {
+		// After a failed body read the end of the request cannot be found
+		// on the connection.
+		rw.CloseConnection()
+	}
+	if handlerError != nil {
+		if rw.Started() {
+			// Part of a response is already out, so cutting it short is
+			// the only way left to signal the failure.
+			return false
+		}
+		err = s.writeHandlerError(rw, handlerError)
+		if err != nil {
+			return false
+		}
+	}
+	if s.IsClosed.Load() {
+		rw.CloseConnection()
+	}
+	closeIfBodyLeft(rw, req)
+	keepAlive, err := rw.Finish()
+	return err == nil && keepAlive
+}
 
+// closeIfBodyLeft makes the response the last on its connection if more of
+// req's body is left unread than the server is willing to discard.
+func closeIfBodyLeft(rw *response.Writer, req *request.Request) {
+	remaining := req.BodyRemaining()
+	if remaining < 0 || remaining > maxDiscardBytes {
+		rw.CloseConnection()
+	}
 }
 
+// Close stops accepting connections and immediately closes every open
+// connection, abandoning requests in flight. Use Shutdown to let them
+// finish.
 func (s *Server) Close() error {
+	s.IsClosed.Store(true)
+	s.cancelBase()
 	err := s.Listener.Close()
-	if err != nil {
-		return err
+	s.closeConns(false)
+	return err
+}
+
+// BodyError returns the error response for a failure reading a request
+// body through BodyReader, matching what the server sends for requests it
+// rejects itself: 408 for a timeout, 413 for a body over the limit and 400
+// otherwise. The server closes the connection after such a failure.
+func BodyError(err error) *HandlerError {
+	herr := requestErrorResponse(err)
+	if herr == nil {
+		herr = &HandlerError{StatusCode: response.StatusBadRequest, Message: "Bad Request: " + err.Error() + "\n"}
 	}
-	s.IsClosed.Store(true)
-	return nil
+	return herr
 }
 
-func writeHandlerError(w io.Writer, h *HandlerError) error {
-	errorString := "HTTP/1.1 " + h.StatusCode + " " + h.Message + "\r\n"
-	errorBytes := []byte(errorString)
-	n, err := w.Write(errorBytes)
-	return response.WriteErrorHelper(err, n, errorBytes)
+// requestErrorResponse picks the error response for a request which failed
+// to parse. It returns nil for failures, like a dropped connection, that
+// leave nobody to answer.
+func requestErrorResponse(err error) *HandlerError {
+	var limitErr *request.LimitError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return &HandlerError{StatusCode: response.StatusRequestTimeout, Message: "Request Timeout\n"}
+	case errors.As(err, &limitErr):
+		herr := &HandlerError{StatusCode: response.StatusRequestHeaderFieldsTooLarge, Message: limitErr.Error() + "\n"}
+		switch limitErr.Kind {
+		case request.LimitRequestLine:
+			herr.StatusCode = response.StatusURITooLong
+		case request.LimitBody:
+			herr.StatusCode = response.StatusContentTooLarge
+		}
+		return herr
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return &HandlerError{StatusCode: response.StatusHTTPVersionNotSupported, Message: err.Error() + "\n"}
+	case errors.Is(err, request.ErrMalformedRequestLine),
+		errors.Is(err, request.ErrMalformedHeader),
+		errors.Is(err, request.ErrMalformedBody):
+		return &HandlerError{StatusCode: response.StatusBadRequest, Message: "Bad Request: " + err.Error() + "\n"}
+	default:
+		return nil
+	}
 }
 
+// Serve listens on port on 127.0.0.1 and serves h in the background with
+// the default timeouts and limits. To choose other settings, fill in a
+// Server and call Start or ServeListener.
 func Serve(port int, h Handler) (*Server, error) {
-	address := fmt.Sprintf("127.0.0.1:%d", port)
-	listener, err := net.Listen("tcp", address)
+	s := &Server{
+		Addr:              fmt.Sprintf("127.0.0.1:%d", port),
+		Handler:           h,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		Limits:            DefaultLimits,
+	}
+	err := s.Start()
 	if err != nil {
 		return nil, err
 	}
+	return s, nil
+}
+
+// Start listens on Addr and begins accepting connections in the background.
+// The Server's fields must not be changed once Start has been called.
+func (s *Server) Start() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ServeListener(listener)
+	return nil
+}
+
+// ServeListener begins accepting connections from l in the background,
+// taking ownership of it. It lets callers bring their own listener, such as
+// a pre-bound socket or an in-memory one. The Server's fields must not be
+// changed once ServeListener has been called.
+func (s *Server) ServeListener(l net.Listener) {
 	var isClosed atomic.Bool
 	isClosed.Store(false)
-	s := Server{
-		Listener: listener,
-		IsClosed: &isClosed,
-		Handler:  h,
-	}
-	fmt.Println("Handler attached")
+	s.Listener = l
+	s.IsClosed = &isClosed
+	s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
 	go s.listen()
-	return &s, nil
 }
@@ -0,0 +1,893 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lucoand/httpfromtcp/internal/headers"
+	"github.com/lucoand/httpfromtcp/internal/request"
+	"github.com/lucoand/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeText answers with a 200 and body as a plain-text body.
+func writeText(w *response.Writer, body string) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func echoTargetHandler(w *response.Writer, req *request.Request) *HandlerError {
+	writeText(w, req.RequestLine.RequestTarget)
+	return nil
+}
+
+// startServer serves h on an ephemeral port and returns a dialed client
+// connection to it.
+func startServer(t *testing.T, h Handler) (*Server, net.Conn) {
+	t.Helper()
+	s, err := Serve(0, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return s, conn
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: Several requests share one connection
+	_, conn := startServer(t, echoTargetHandler)
+	br := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two", "/three"} {
+		_, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		resp, body := readResponse(t, br)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, target, body)
+		assert.False(t, resp.Close)
+	}
+
+	// Test: Connection: close from the client ends the connection
+	_, err := conn.Write([]byte("GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, "/last", body)
+	assert.True(t, resp.Close)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection: close from the handler ends the connection too
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h.Set("Connection", "close")
+		w.WriteHeaders(h)
+		return nil
+	})
+	br = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /second HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, br)
+	assert.True(t, resp.Close)
+	// The unread second request may make the close a reset rather than
+	// an EOF; either way it must not be answered.
+	_, err = http.ReadResponse(br, nil)
+	assert.Error(t, err)
+}
+
+func TestHead(t *testing.T) {
+	// Test: HEAD responses carry no body, from the handler or an error
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/missing" {
+			return &HandlerError{StatusCode: response.StatusNotFound, Message: "Not found\n"}
+		}
+		writeText(w, req.RequestLine.RequestTarget)
+		return nil
+	})
+	_, err := conn.Write([]byte("HEAD /page HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"HEAD /missing HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(len("/page")), resp.ContentLength)
+	assert.False(t, resp.Close)
+	resp, err = http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.False(t, resp.Close)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/next", body)
+}
+
+func TestPipelining(t *testing.T) {
+	// Test: Requests sent in a single write are answered in order
+	_, conn := startServer(t, echoTargetHandler)
+	targets := []string{"/a", "/b", "/c", "/d"}
+	pipelined := ""
+	for _, target := range targets {
+		pipelined += "POST " + target + " HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nxyz"
+	}
+	_, err := conn.Write([]byte(pipelined))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for _, target := range targets {
+		resp, body := readResponse(t, br)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, target, body)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// Test: In-flight requests finish while idle connections are closed
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	s, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		entered <- struct{}{}
+		<-release
+		writeText(w, "done")
+		return nil
+	})
+	idle, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the active request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	br := bufio.NewReader(conn)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, "done", body)
+	assert.True(t, resp.Close)
+	require.NoError(t, <-shutdownErr)
+
+	// Test: Expired context force-closes remaining connections
+	release = make(chan struct{})
+	defer close(release)
+	s, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Client disconnect cancels the request context
+	cancelled := make(chan error, 1)
+	entered := make(chan struct{}, 1)
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		entered <- struct{}{}
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+		return nil
+	})
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+	conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Shutdown cancels the request context
+	s, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		entered <- struct{}{}
+		<-req.Context().Done()
+		writeText(w, "aborted")
+		return nil
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "aborted", body)
+
+	// Test: Pipelined bytes picked up while the handler runs are kept
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		writeText(w, req.RequestLine.RequestTarget)
+		return nil
+	})
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write([]byte("GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "/slow", body)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "/next", body)
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	// Test: The handler reads the body while the client is still sending it
+	firstPart := make(chan string, 1)
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/ignore" {
+			writeText(w, "ignored")
+			return nil
+		}
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(req.BodyReader, buf)
+		if err != nil {
+			return BodyError(err)
+		}
+		firstPart <- string(buf)
+		rest, err := io.ReadAll(req.BodyReader)
+		if err != nil {
+			return BodyError(err)
+		}
+		if !req.BodyConsumed() {
+			return &HandlerError{StatusCode: response.StatusInternalServerError, Message: "body not consumed\n"}
+		}
+		writeText(w, string(buf)+string(rest))
+		return nil
+	})
+	br := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", <-firstPart)
+	_, err = conn.Write([]byte(" world"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello world", body)
+
+	// Test: A body the handler leaves unread is skipped before the next
+	// request on the connection
+	_, err = conn.Write([]byte("POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /ignore HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, br)
+	assert.Equal(t, "ignored", body)
+	assert.False(t, resp.Close)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "ignored", body)
+
+	// Test: A large or chunked body the handler refuses closes the
+	// connection rather than being read to the end
+	refuse := func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{StatusCode: response.StatusContentTooLarge, Message: "Too large\n"}
+	}
+	for _, framing := range []string{"Content-Length: 5000000", "Transfer-Encoding: chunked"} {
+		_, conn = startServer(t, refuse)
+		_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\n" + framing + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, _ = readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, 413, resp.StatusCode, framing)
+		assert.True(t, resp.Close, framing)
+	}
+}
+
+// startConfiguredServer starts s on an ephemeral port and returns a dialed
+// client connection to it.
+func startConfiguredServer(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestTimeouts(t *testing.T) {
+	// Test: Idle connections are closed without a response
+	conn := startConfiguredServer(t, &Server{
+		Handler:     echoTargetHandler,
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A request line that never completes gets a 408
+	conn = startConfiguredServer(t, &Server{
+		Handler:           echoTargetHandler,
+		ReadHeaderTimeout: 50 * time.Millisecond,
+	})
+	_, err = conn.Write([]byte("GET /slow"))
+	require.NoError(t, err)
+	resp, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	// Test: A body that never completes gets a 408 from a handler reading it
+	conn = startConfiguredServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) *HandlerError {
+			_, err := req.ReadBody()
+			if err != nil {
+				return BodyError(err)
+			}
+			return nil
+		},
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	// Test: WriteTimeout becomes the request context's deadline
+	var hasDeadline bool
+	conn = startConfiguredServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) *HandlerError {
+			_, hasDeadline = req.Context().Deadline()
+			return nil
+		},
+		WriteTimeout: time.Second,
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, hasDeadline)
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := request.Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}
+	cases := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"request line", "GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\n\r\n", 414},
+		{"header bytes", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 80) + "\r\n\r\n", 431},
+		{"header count", "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", 431},
+		{"body", "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789", 413},
+	}
+	for _, c := range cases {
+		// Test: Each exceeded limit is answered with its own status
+		conn := startConfiguredServer(t, &Server{
+			Handler: echoTargetHandler,
+			Limits:  limits,
+		})
+		_, err := conn.Write([]byte(c.req))
+		require.NoError(t, err, c.name)
+		resp, _ := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, c.status, resp.StatusCode, c.name)
+		assert.True(t, resp.Close, c.name)
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	cases := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"bad request line", "GET /\r\n\r\n", 400},
+		{"bad header", "GET / HTTP/1.1\r\nHost localhost\r\n\r\n", 400},
+		{"bad content-length", "POST / HTTP/1.1\r\nContent-Length: x\r\n\r\n", 400},
+		{"bad chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", 400},
+		{"unsupported version", "GET / HTTP/2.0\r\n\r\n", 505},
+		{"control character in value", "GET / HTTP/1.1\r\nHost: local\x00host\r\n\r\n", 400},
+		{"bare LF in value", "GET / HTTP/1.1\r\nHost: localhost\nX-Injected: 1\r\n\r\n", 400},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n b\r\n\r\n", 400},
+		{"te with cl", "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", 400},
+		{"differing cl", "POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", 400},
+		{"chunked not final", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, identity\r\n\r\n", 400},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : localhost\r\n\r\n", 400},
+		{"bad path escape", "GET /a%zz HTTP/1.1\r\nHost: localhost\r\n\r\n", 400},
+	}
+	for _, c := range cases {
+		// Test: Parse failures are answered before the connection closes
+		_, conn := startServer(t, echoTargetHandler)
+		_, err := conn.Write([]byte(c.req))
+		require.NoError(t, err, c.name)
+		resp, body := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, c.status, resp.StatusCode, c.name)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"), c.name)
+		assert.NotEmpty(t, body, c.name)
+		assert.True(t, resp.Close, c.name)
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	// Test: A server configured to unfold obs-fold hands the joined value
+	// to the handler
+	echoLong := func(w *response.Writer, req *request.Request) *HandlerError {
+		writeText(w, req.Headers.Get("x-long"))
+		return nil
+	}
+	conn := startConfiguredServer(t, &Server{Handler: echoLong, HeaderPolicy: headers.Policy{UnfoldObsFold: true}})
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n\tb\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "a b", body)
+
+	// Test: A handler echoing a CRLF into a header cannot split the response
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h.Set("X-Echo", req.Headers.Get("x-echo")+"\r\nSet-Cookie: evil=1")
+		err := w.WriteHeaders(h)
+		if err != nil {
+			h.Del("X-Echo")
+			w.WriteHeaders(h)
+		}
+		return nil
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Echo: hi\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Set-Cookie"))
+
+	// Test: A server rejecting obs-text refuses to send it as well
+	var writeErr error
+	conn = startConfiguredServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) *HandlerError {
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Set("X-Name", "caf\xe9")
+			writeErr = w.WriteHeaders(h)
+			if writeErr != nil {
+				h.Del("X-Name")
+				w.WriteHeaders(h)
+			}
+			return nil
+		},
+		HeaderPolicy: headers.Policy{RejectObsText: true},
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Error(t, writeErr)
+	assert.Empty(t, resp.Header.Get("X-Name"))
+}
+
+func TestHandlerError(t *testing.T) {
+	retryAfter := headers.NewHeaders()
+	retryAfter.Set("Retry-After", "120")
+	failing := func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{
+			StatusCode: response.StatusBadRequest,
+			Message:    "Your problem is <not> my problem\n",
+			Headers:    retryAfter,
+		}
+	}
+
+	// Test: Default text rendering keeps the connection usable
+	_, conn := startServer(t, failing)
+	br := bufio.NewReader(conn)
+	for range 2 {
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		resp, body := readResponse(t, br)
+		assert.Equal(t, 400, resp.StatusCode)
+		assert.Equal(t, "400 Bad Request", resp.Status)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "120", resp.Header.Get("Retry-After"))
+		assert.Equal(t, "Your problem is <not> my problem\n", body)
+		assert.False(t, resp.Close)
+	}
+
+	// Test: HTML rendering escapes the message
+	conn = startConfiguredServer(t, &Server{Handler: failing, ErrorRenderer: HTMLErrorRenderer})
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<title>400 Bad Request</title>")
+	assert.Contains(t, body, "Your problem is &lt;not&gt; my problem")
+
+	// Test: JSON rendering also applies to errors raised by the server
+	conn = startConfiguredServer(t, &Server{Handler: failing, ErrorRenderer: JSONErrorRenderer})
+	_, err = conn.Write([]byte("GET / HTTP/9.9\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 505, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `"status":505`)
+	assert.Contains(t, body, `"error":"HTTP Version Not Supported"`)
+
+	// Test: A missing status code becomes a 500
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		return &HandlerError{Message: "oops\n"}
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, "oops\n", body)
+}
+
+func TestChunkedStreaming(t *testing.T) {
+	// Test: Each chunk reaches the client before the handler returns
+	next := make(chan struct{})
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetChunkedHeaders(response.TrailerContentSHA256, response.TrailerContentLength))
+		for _, line := range []string{"first\n", "second\n"} {
+			w.WriteChunkedBody([]byte(line))
+			<-next
+		}
+		return nil
+	})
+	_, err := conn.Write([]byte("GET /tail HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	line := make([]byte, len("first\n"))
+	_, err = io.ReadFull(resp.Body, line)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(line))
+	next <- struct{}{}
+	next <- struct{}{}
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+	assert.Equal(t, "13", resp.Trailer.Get("X-Content-Length"))
+	assert.Len(t, resp.Trailer.Get("X-Content-Sha256"), 64)
+}
+
+func TestChain(t *testing.T) {
+	// tag records the order middleware runs in and adds a response header.
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) *HandlerError {
+				order = append(order, name+" before")
+				w.BeforeHeaders(func(h *headers.Headers) {
+					h.Set("X-"+name, "yes")
+				})
+				herr := next(w, req)
+				order = append(order, name+" after")
+				return herr
+			}
+		}
+	}
+	deny := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *HandlerError {
+			if req.Headers.Get("authorization") == "" {
+				return &HandlerError{StatusCode: response.StatusUnauthorized, Message: "Unauthorized\n"}
+			}
+			return next(w, req)
+		}
+	}
+
+	// Test: The first middleware is the outermost
+	_, conn := startServer(t, Chain(echoTargetHandler, tag("outer"), tag("inner"), deny))
+	br := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("GET /chained HTTP/1.1\r\nHost: localhost\r\nAuthorization: yes\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/chained", body)
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, order)
+	assert.Equal(t, "yes", resp.Header.Get("X-Outer"))
+	assert.Equal(t, "yes", resp.Header.Get("X-Inner"))
+
+	// Test: Middleware can answer without calling the wrapped handler
+	_, err = conn.Write([]byte("GET /chained HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body = readResponse(t, br)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "Unauthorized\n", body)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	panics := make(chan any, 2)
+	s := &Server{
+		Handler: func(w *response.Writer, req *request.Request) *HandlerError {
+			if req.RequestLine.RequestTarget == "/late" {
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(response.GetDefaultHeaders(100))
+				w.WriteBody([]byte("partial"))
+			}
+			panic("boom " + req.RequestLine.RequestTarget)
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		OnPanic: func(req *request.Request, recovered any, stack []byte) {
+			assert.NotEmpty(t, stack)
+			panics <- recovered
+		},
+	}
+
+	// Test: A panic before anything was written is answered with 500
+	conn := startConfiguredServer(t, s)
+	br := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("GET /early HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ := readResponse(t, br)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assert.Equal(t, "boom /early", <-panics)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A panic mid-response aborts the connection, and the server
+	// keeps serving others
+	conn, err = net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "boom /late", <-panics)
+}
+
+// syncBuffer is a bytes.Buffer safe to write from the server while the
+// test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	clf := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] `)
+	request := "GET /logged HTTP/1.1\r\nHost: localhost\r\nUser-Agent: tester\r\n\r\n"
+
+	// Test: Common Log Format, followed by the duration
+	var logs syncBuffer
+	conn := startConfiguredServer(t, &Server{Handler: echoTargetHandler, AccessLog: &logs})
+	_, err := conn.Write([]byte(request))
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	line := logs.String()
+	assert.Regexp(t, clf, line)
+	assert.Regexp(t, `\] "GET /logged HTTP/1\.1" 200 7 \d+\n$`, line)
+
+	// Test: Combined adds the referer and user agent
+	logs = syncBuffer{}
+	conn = startConfiguredServer(t, &Server{Handler: echoTargetHandler, AccessLog: &logs, AccessLogFormat: AccessLogCombined})
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	line = logs.String()
+	assert.Regexp(t, clf, line)
+	assert.Regexp(t, `\] "GET /logged HTTP/1\.1" 200 7 "-" "tester" \d+\n$`, line)
+
+	// Test: JSON, including requests the server rejects itself
+	logs = syncBuffer{}
+	conn = startConfiguredServer(t, &Server{Handler: echoTargetHandler, AccessLog: &logs, AccessLogFormat: AccessLogJSON})
+	_, err = conn.Write([]byte("GET /logged HTTP/9.9\r\n\r\n"))
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(logs.String()), &entry))
+	assert.Equal(t, "127.0.0.1", entry["remote_addr"])
+	assert.EqualValues(t, 505, entry["status"])
+	assert.NotContains(t, entry, "method")
+	assert.Contains(t, entry, "duration_us")
+}
+
+// pipeListener is an in-memory net.Listener handing out net.Pipe
+// connections.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Dial returns the client end of a new connection to the listener.
+func (l *pipeListener) Dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// failingListener is a pipeListener whose first failures Accept calls
+// fail with err.
+type failingListener struct {
+	*pipeListener
+	err      error
+	failures int32
+	accepts  atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.accepts.Add(1) <= l.failures {
+		return nil, l.err
+	}
+	return l.pipeListener.Accept()
+}
+
+func TestAcceptErrors(t *testing.T) {
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Test: Temporary Accept errors are retried after a pause
+	l := &failingListener{pipeListener: newPipeListener(), err: syscall.EMFILE, failures: 3}
+	s := &Server{Handler: echoTargetHandler, Logger: quiet}
+	s.ServeListener(l)
+	defer s.Close()
+	conn := l.Dial()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("GET /after HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/after", body)
+
+	// Test: A listener closed by its owner stops the accept loop
+	l = &failingListener{pipeListener: newPipeListener()}
+	s = &Server{Handler: echoTargetHandler, Logger: quiet}
+	s.ServeListener(l)
+	defer s.Close()
+	l.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), l.accepts.Load())
+}
+
+func TestServeListener(t *testing.T) {
+	// Test: Requests are served from an injected in-memory listener
+	l := newPipeListener()
+	s := &Server{Handler: echoTargetHandler}
+	s.ServeListener(l)
+	defer s.Close()
+	conn := l.Dial()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write([]byte("GET /in-memory HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/in-memory", body)
+
+	// Test: Addr selects the interface, here IPv6 loopback when available
+	s = &Server{Addr: "[::1]:0", Handler: echoTargetHandler}
+	err := s.Start()
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer s.Close()
+	assert.Equal(t, "::1", s.Listener.Addr().(*net.TCPAddr).IP.String())
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 is answered in kind and closed by default
+	_, conn := startServer(t, echoTargetHandler)
+	br := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("GET /old HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	resp, body := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.0", resp.Proto)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/old", body)
+	assert.True(t, resp.Close)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection: keep-alive keeps an HTTP/1.0 connection open
+	_, conn = startServer(t, echoTargetHandler)
+	br = bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two"} {
+		_, err = conn.Write([]byte("GET " + target + " HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+		require.NoError(t, err)
+		resp, body = readResponse(t, br)
+		assert.Equal(t, target, body)
+		assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	}
+
+	// Test: A chunked body reaches an HTTP/1.0 client as plain data
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetChunkedHeaders(response.TrailerContentLength))
+		w.WriteChunkedBody([]byte("streamed "))
+		w.WriteChunkedBody([]byte("data"))
+		return nil
+	})
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.0 200 OK\r\n"))
+	assert.NotContains(t, strings.ToLower(string(raw)), "transfer-encoding")
+	assert.Contains(t, string(raw), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\nstreamed data"))
+
+	// Test: HTTP/1.1 requests must carry Host, HTTP/1.0 ones need not
+	_, conn = startServer(t, echoTargetHandler)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	resp, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type connState int
+
+const (
+	// connStateIdle covers new connections and keep-alive connections
+	// waiting for their next request.
+	connStateIdle connState = iota
+	connStateActive
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the remaining
+// connections have finished.
+const shutdownPollInterval = 10 * time.Millisecond
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]connState)
+	}
+	s.conns[conn] = state
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeConns closes tracked connections, only the idle ones if idleOnly is
+// set, and reports how many connections are still being served. Closed
+// connections stay tracked until their goroutine exits.
+func (s *Server) closeConns(idleOnly bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if !idleOnly || state == connStateIdle {
+			conn.Close()
+		}
+	}
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections, cancels the context of every
+// request in flight, closes idle connections, and waits for those requests
+// to complete; each of those connections is closed once
+// its response has been written. If ctx expires first, the remaining
+// connections are closed forcibly and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.IsClosed.Store(true)
+	s.cancelBase()
+	err := s.Listener.Close()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.closeConns(true) > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}